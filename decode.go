@@ -0,0 +1,132 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// ResizeReader decodes an image in any of the registered formats
+// (JPEG, PNG and GIF are always available) and resizes it according to
+// sizeStr. It returns the resized image and the name of the format the
+// source was in.
+//
+// If the source (JPEG or PNG) has an EXIF Orientation tag, the image
+// is turned the right way up before anything else happens, so crops
+// happen along the axes a person looking at the photo would expect.
+func ResizeReader(r io.Reader, sizeStr string) (image.Image, string, error) {
+	src, err := decodeOriented(r, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return Resize(src.image, sizeStr), src.format, nil
+}
+
+// source is a decoded image, and what we found out while decoding it
+type source struct {
+	image  image.Image
+	format string
+	meta   *metadata
+	// bounds is the size of the image at full scale, the right way up.
+	// it's only different from image's bounds if it was shrunk on load,
+	// by a factor of scale.
+	bounds image.Rectangle
+	scale  int
+}
+
+// plan adjusts a plan made for the full size source (see bounds) for
+// the image that was actually decoded
+func (self *source) plan(plan ResizePlan) ResizePlan {
+	if self.scale <= 1 {
+		return plan
+	}
+	return plan.shrunk(self.scale, self.image.Bounds())
+}
+
+// decodeOriented decodes an image and applies its EXIF orientation.
+//
+// specs are the size specs the image is going to be resized to. if
+// opts has Limits, the header and the plans for the specs are checked
+// against them before decoding. if opts.ShrinkOnLoad is set and the
+// image is a JPEG, it's decoded at 1/2, 1/4 or 1/8 size if that still
+// leaves enough pixels for all the specs (see shrinkScale).
+func decodeOriented(r io.Reader, specs []*SizeSpec, opts *Options) (*source, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	data, err := opts.Limits.readInput(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Limits.CheckConfig(cfg); err != nil {
+		return nil, err
+	}
+	meta := readMetadata(data, format, opts.metadataParts())
+	if err := opts.Limits.checkInput(cfg, int64(len(data))+meta.size()); err != nil {
+		return nil, err
+	}
+	o := OrientationNormal
+	if meta.exif != nil {
+		o = exifOrientation(meta.exif)
+	}
+	bounds := image.Rect(0, 0, cfg.Width, cfg.Height)
+	if o.IsValid() {
+		bounds = o.Bounds(bounds)
+	}
+	for _, ss := range specs {
+		if err := opts.Limits.CheckPlan(opts.plan(ss, bounds)); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ShrinkOnLoad && format == "jpeg" {
+		if scale := shrinkScale(bounds, specs, opts); scale > 1 {
+			if m, err := decodeJPEGScaled(data, scale); err == nil {
+				return &source{image: Orient(m, o), format: format, meta: meta, bounds: bounds, scale: scale}, nil
+			}
+			// not something the scaled decoder can handle
+		}
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	m = Orient(m, o)
+	return &source{image: m, format: format, meta: meta, bounds: m.Bounds(), scale: 1}, nil
+}
+
+// shrinkScale returns the biggest JPEG decoding scale (8, 4 or 2) that
+// still leaves the crop of every spec at least opts.ShrinkMargin times
+// the size of its output in both directions, or 1 if none do (or there
+// are no specs). A margin below 1 is taken as the default of 2.
+func shrinkScale(bounds image.Rectangle, specs []*SizeSpec, opts *Options) int {
+	if len(specs) == 0 {
+		return 1
+	}
+	margin := opts.ShrinkMargin
+	if margin < 1 {
+		margin = 2
+	}
+	scale := 8
+	for _, ss := range specs {
+		if ss.trim != nil {
+			// the borders aren't known until it's decoded, and
+			// what's inside them could need every pixel
+			return 1
+		}
+		if s := opts.plan(ss, bounds).maxShrink(margin); s < scale {
+			scale = s
+		}
+	}
+	return scale
+}
@@ -1,43 +1,46 @@
 package main
 
 import (
-	"../../resize"
 	"flag"
 	"fmt"
-	"image/jpeg"
 	"log"
 	"os"
+
+	"github.com/thraxil/resize"
 )
 
 func main() {
 	var source string
-	flag.StringVar(&source,"source", "./test.jpg", "image to read")
+	flag.StringVar(&source, "source", "./test.jpg", "image to read")
 	var dest string
 	flag.StringVar(&dest, "dest", "./out.jpg", "image to output")
 
 	var sizeStr string
-
 	flag.StringVar(&sizeStr, "size", "100w", "size to resize to")
 
-  flag.Parse()
+	var format string
+	flag.StringVar(&format, "format", "", "output format (jpeg, png or gif). defaults to the source's format")
+	var quality int
+	flag.IntVar(&quality, "quality", 0, "JPEG quality, 1-100")
+
+	flag.Parse()
 	file, err := os.Open(source)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer file.Close()
 
-	// Decode the image.
-	m, err := jpeg.Decode(file)
+	fl, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		fmt.Printf("error decoding image\n")
-		log.Fatal(err)
+		log.Fatal("couldn't write ", err)
 	}
-	outputImage := resize.Resize(m, sizeStr)
-	fl, err := os.OpenFile(dest, os.O_CREATE|os.O_RDWR, 0644)
+	res, err := resize.ResizeStream(fl, file, sizeStr, &resize.Options{Format: format, JPEGQuality: quality})
 	if err != nil {
-		fmt.Println("couldn't write", err)
-		return
+		fl.Close()
+		log.Fatal(err)
+	}
+	if err := fl.Close(); err != nil {
+		log.Fatal(err)
 	}
-	defer fl.Close()
-	jpeg.Encode(fl, outputImage, nil)
+	fmt.Printf("wrote %dx%d %s, %d bytes\n", res.Width, res.Height, res.Format, res.Bytes)
 }
@@ -0,0 +1,141 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// just enough JPEG and EXIF parsing to find the metadata we care
+// about. no cgo, no external libraries.
+
+var exifHeader = []byte("Exif\x00\x00")
+
+const (
+	exifTagOrientation = 0x0112
+	exifTypeShort      = 3
+)
+
+// jpegSegment is a marker segment from the header of a JPEG file.
+// payload doesn't include the marker or length bytes.
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// jpegSegments returns the marker segments of a JPEG up to the start
+// of the image data. it stops quietly at anything it doesn't understand.
+func jpegSegments(data []byte) []jpegSegment {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	var segments []jpegSegment
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// no payload
+			i += 2
+			continue
+		}
+		if marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: data[i+4 : i+2+n]})
+		if marker == 0xda {
+			// start of scan, the rest is image data
+			break
+		}
+		i += 2 + n
+	}
+	return segments
+}
+
+// jpegExif returns the TIFF structure from a JPEG's EXIF segment, or nil
+func jpegExif(data []byte) []byte {
+	for _, s := range jpegSegments(data) {
+		if s.marker == 0xe1 && bytes.HasPrefix(s.payload, exifHeader) {
+			return s.payload[len(exifHeader):]
+		}
+	}
+	return nil
+}
+
+// ifdEntry is a single tag in a TIFF image file directory. offset is
+// where the entry starts in the TIFF data.
+type ifdEntry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset int
+}
+
+// exifIFD0 parses the first IFD of a TIFF structure
+func exifIFD0(tiff []byte) (binary.ByteOrder, []ifdEntry, bool) {
+	if len(tiff) < 8 {
+		return nil, nil, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, false
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, nil, false
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil, nil, false
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	var entries []ifdEntry
+	for i := 0; i < n; i++ {
+		off := ifd + 2 + i*12
+		if off+12 > len(tiff) {
+			break
+		}
+		entries = append(entries, ifdEntry{
+			tag:    order.Uint16(tiff[off:]),
+			typ:    order.Uint16(tiff[off+2:]),
+			count:  order.Uint32(tiff[off+4:]),
+			offset: off,
+		})
+	}
+	return order, entries, true
+}
+
+// exifOrientation returns the orientation from EXIF data, or
+// OrientationNormal if there isn't a valid one
+func exifOrientation(tiff []byte) Orientation {
+	order, entries, ok := exifIFD0(tiff)
+	if !ok {
+		return OrientationNormal
+	}
+	for _, e := range entries {
+		if e.tag == exifTagOrientation && e.typ == exifTypeShort && e.count == 1 {
+			o := Orientation(order.Uint16(tiff[e.offset+8:]))
+			if o.IsValid() {
+				return o
+			}
+		}
+	}
+	return OrientationNormal
+}
@@ -0,0 +1,98 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// exifSegment builds an APP1 EXIF segment with just an orientation tag
+func exifSegment(order binary.ByteOrder, o Orientation) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, uint16(exifTagOrientation))
+	binary.Write(&tiff, order, uint16(exifTypeShort))
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, uint16(o))
+	binary.Write(&tiff, order, uint16(0))
+	binary.Write(&tiff, order, uint32(0))
+
+	payload := append(append([]byte{}, exifHeader...), tiff.Bytes()...)
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// withSegment inserts a marker segment into a JPEG right after the SOI
+func withSegment(jpg, seg []byte) []byte {
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, seg...)
+	return append(out, jpg[2:]...)
+}
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	testPattern(m)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_ExifOrientation(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := OrientationNormal; o <= OrientationRotate270; o++ {
+			data := withSegment(jpg, exifSegment(order, o))
+			if got := exifOrientation(jpegExif(data)); got != o {
+				t.Error(order, o, "-- read orientation", got)
+			}
+		}
+	}
+	if exifOrientation(jpegExif(jpg)) != OrientationNormal {
+		t.Error("no EXIF should be OrientationNormal")
+	}
+	if exifOrientation([]byte("MM\x00\x2a\xff\xff\xff\xff")) != OrientationNormal {
+		t.Error("bad IFD offset should be OrientationNormal")
+	}
+}
+
+func Test_ResizeReader(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+
+	m, format, err := ResizeReader(bytes.NewReader(jpg), "20w")
+	if err != nil || format != "jpeg" {
+		t.Fatal(err, format)
+	}
+	if m.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Error("no orientation -- bad bounds", m.Bounds())
+	}
+
+	data := withSegment(jpg, exifSegment(binary.BigEndian, OrientationRotate90))
+	m, _, err = ResizeReader(bytes.NewReader(data), "10w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Bounds() != image.Rect(0, 0, 10, 20) {
+		t.Error("rotated -- bad bounds", m.Bounds())
+	}
+	// the crop should be along the rotated image's long side
+	m, _, _ = ResizeReader(bytes.NewReader(data), "10w5h")
+	if m.Bounds() != image.Rect(0, 0, 10, 5) {
+		t.Error("rotated crop -- bad bounds", m.Bounds())
+	}
+
+	if _, _, err := ResizeReader(bytes.NewReader([]byte("not an image")), "10w"); err == nil {
+		t.Error("expected an error decoding garbage")
+	}
+}
@@ -0,0 +1,85 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+// parseBackground parses the part of a "bg" spec component after the
+// "bg": a colour as 6 (or 8, with alpha) hex digits
+func parseBackground(str string) (color.Color, bool) {
+	if len(str) != 6 && len(str) != 8 {
+		return nil, false
+	}
+	c, ok := parseHexColor(strings.ToLower(str))
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+// Flatten returns m composited onto a solid background colour, so it's
+// opaque, as it has to be for formats without transparency, like JPEG.
+// If m is already opaque, it's returned as it is.
+func Flatten(m image.Image, bg color.Color) image.Image {
+	if o, ok := m.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return m
+	}
+	b := m.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, m, b.Min, draw.Src)
+	flattenRGBA(out, bg)
+	return out
+}
+
+// flattenRGBA composites m onto bg in place
+func flattenRGBA(m *image.RGBA, bg color.Color) {
+	if bg == nil || m.Rect.Empty() {
+		return
+	}
+	r, g, b, a := bg.RGBA()
+	c := [4]uint32{r >> 8, g >> 8, b >> 8, a >> 8}
+	w := m.Rect.Dx()
+	for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+		i := m.PixOffset(m.Rect.Min.X, y)
+		row := m.Pix[i : i+4*w]
+		for x := 0; x < len(row); x += 4 {
+			// premultiplied, so the background just fills in
+			// whatever the pixel doesn't cover
+			rest := 255 - uint32(row[x+3])
+			if rest == 0 {
+				continue
+			}
+			for k := 0; k < 4; k++ {
+				row[x+k] += uint8((c[k]*rest + 127) / 255)
+			}
+		}
+	}
+}
+
+// flattenInto composites dst onto bg in place, whatever kind of image
+// it is
+func flattenInto(dst draw.Image, bg color.Color) {
+	if bg == nil {
+		return
+	}
+	if rgba, ok := dst.(*image.RGBA); ok {
+		flattenRGBA(rgba, bg)
+		return
+	}
+	b := dst.Bounds()
+	tmp := image.NewRGBA(b)
+	draw.Draw(tmp, b, dst, b.Min, draw.Src)
+	flattenRGBA(tmp, bg)
+	draw.Draw(dst, b, tmp, b.Min, draw.Src)
+}
+
+// hasAlpha is true for the output formats that can be transparent
+func hasAlpha(format string) bool {
+	return format != "jpeg"
+}
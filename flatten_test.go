@@ -0,0 +1,153 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+type bgSpecTestCase struct {
+	Spec      string
+	Canonical string
+}
+
+func Test_BackgroundSpec(t *testing.T) {
+	cases := []bgSpecTestCase{
+		{"200w-bgFFFFFF", "200w-bgffffff"},
+		{"bgff000080-100s", "100s-bgff000080"},
+		{"bg00ff00-100s-sharp", "100s-sharp-bg00ff00"},
+		{"bg000000", "full-bg000000"},
+		// invalid colours are ignored
+		{"100s-bg", "100s"},
+		{"100s-bgfff", "100s"},
+		{"100s-bgxyzxyz", "100s"},
+		{"100s-bg+fffff", "100s"},
+	}
+	for _, c := range cases {
+		got := MakeSizeSpec(c.Spec).Canonical()
+		if got != c.Canonical {
+			t.Errorf("%s -- got %q, expected %q", c.Spec, got, c.Canonical)
+		}
+		if again := MakeSizeSpec(got).Canonical(); again != got {
+			t.Errorf("%s -- canonical form %q isn't stable, got %q", c.Spec, got, again)
+		}
+	}
+}
+
+// fadingRed is a w x h red image that goes from transparent on the
+// left to opaque on the right
+func fadingRed(w, h int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{255, 0, 0, uint8(255 * x / (w - 1))})
+		}
+	}
+	return m
+}
+
+func Test_Flatten(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	m.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 0})
+	m.SetNRGBA(1, 0, color.NRGBA{255, 0, 0, 128})
+	m.SetNRGBA(2, 0, color.NRGBA{255, 0, 0, 255})
+	out := Flatten(m, color.White).(*image.RGBA)
+	expected := []color.RGBA{{255, 255, 255, 255}, {255, 127, 127, 255}, {255, 0, 0, 255}}
+	for x, e := range expected {
+		if got := out.RGBAAt(x, 0); got != e {
+			t.Error(x, "-- got", got, "expected", e)
+		}
+	}
+	if !out.Opaque() {
+		t.Error("flattened image isn't opaque")
+	}
+	opaque := image.NewGray(image.Rect(0, 0, 2, 2))
+	if Flatten(opaque, color.White) != image.Image(opaque) {
+		t.Error("an opaque image should be left alone")
+	}
+	// a translucent background leaves it translucent
+	out = Flatten(m, color.NRGBA{0, 0, 255, 128}).(*image.RGBA)
+	if got := out.RGBAAt(0, 0); got != (color.RGBA{0, 0, 128, 128}) {
+		t.Error("translucent background", got)
+	}
+}
+
+func Test_ResizeBackground(t *testing.T) {
+	m := fadingRed(40, 20)
+	out := Resize(m, "20w-bg00ff00").(*image.RGBA)
+	if !out.Opaque() {
+		t.Error("not flattened")
+	}
+	if out.RGBAAt(0, 0).G < 240 || out.RGBAAt(19, 0).R < 240 {
+		t.Error("bad flattening", out.RGBAAt(0, 0), out.RGBAAt(19, 0))
+	}
+	dst := image.NewNRGBA(out.Bounds())
+	if err := ResizeInto(dst, m, MakeSizeSpec("20w-bg00ff00")); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Opaque() || color.RGBAModel.Convert(dst.At(0, 0)) != color.RGBAModel.Convert(out.At(0, 0)) {
+		t.Error("ResizeInto differs", dst.At(0, 0), out.At(0, 0))
+	}
+	if plain := Resize(m, "20w").(*image.RGBA); plain.Opaque() {
+		t.Error("no bg shouldn't flatten")
+	}
+}
+
+func Test_StreamBackground(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, fadingRed(40, 20)); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		spec   string
+		opts   *Options
+		decode func(*bytes.Buffer) (image.Image, error)
+		left   color.RGBA // what the transparent edge should come out as
+	}{
+		{"jpeg", "20w", &Options{Format: "jpeg"}, func(b *bytes.Buffer) (image.Image, error) { return jpeg.Decode(b) }, color.RGBA{255, 255, 255, 255}},
+		{"jpeg, black", "20w", &Options{Format: "jpeg", Background: color.Black}, func(b *bytes.Buffer) (image.Image, error) { return jpeg.Decode(b) }, color.RGBA{0, 0, 0, 255}},
+		{"jpeg, spec", "20w-bg0000ff", &Options{Format: "jpeg", Background: color.Black}, func(b *bytes.Buffer) (image.Image, error) { return jpeg.Decode(b) }, color.RGBA{0, 0, 255, 255}},
+		{"png", "20w", nil, func(b *bytes.Buffer) (image.Image, error) { return png.Decode(b) }, color.RGBA{0, 0, 0, 0}},
+		{"png, spec", "20w-bg0000ff", nil, func(b *bytes.Buffer) (image.Image, error) { return png.Decode(b) }, color.RGBA{0, 0, 255, 255}},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		if _, err := ResizeStream(&out, bytes.NewReader(src.Bytes()), c.spec, c.opts); err != nil {
+			t.Fatal(c.name, err)
+		}
+		m, err := c.decode(&out)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		got := color.RGBAModel.Convert(m.At(0, 5)).(color.RGBA)
+		if !near(got.R, c.left.R, 24) || !near(got.G, c.left.G, 24) || !near(got.B, c.left.B, 24) || !near(got.A, c.left.A, 24) {
+			t.Error(c.name, "-- transparent edge is", got, "expected", c.left)
+		}
+	}
+}
+
+func Test_StreamBackgroundColorManaged(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 20, 20))); err != nil {
+		t.Fatal(err)
+	}
+	src := embedMetadata(buf.Bytes(), "png", &metadata{icc: buildICC(adobeColorants, 2.2, false)})
+
+	// the background is sRGB, so the profile shouldn't touch it
+	var out bytes.Buffer
+	if _, err := ResizeStream(&out, bytes.NewReader(src), "bg336699-full", &Options{ColorManage: true}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := color.RGBAModel.Convert(m.At(10, 10)).(color.RGBA)
+	if got != (color.RGBA{0x33, 0x66, 0x99, 255}) {
+		t.Error("background colour changed to", got)
+	}
+}
@@ -0,0 +1,160 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// ErrNoFrames is returned by ResizeGIF for a GIF without any frames.
+var ErrNoFrames = errors.New("resize: GIF has no frames")
+
+// ResizeGIF resizes every frame of an animated GIF according to sizeStr.
+//
+// Frames in a GIF are often just the part of the picture that changed,
+// drawn over what came before, so each frame is composited onto the
+// full canvas (following the disposal methods) before being cropped and
+// scaled. That way the crop is the same for every frame, and so is a
+// trim, which goes by the borders all the frames share. The output
+// frames each cover the whole canvas, so they can show colours from
+// earlier frames, and each gets a new palette of its own from
+// MedianCut, with a transparent entry if it needs one. Delays, the loop
+// count and the background colour are kept.
+func ResizeGIF(g *gif.GIF, sizeStr string) (*gif.GIF, error) {
+	if len(g.Image) == 0 {
+		return nil, ErrNoFrames
+	}
+	ss := MakeSizeSpec(sizeStr)
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		// not read from a file, so work out the canvas from the frames
+		bounds = image.Rectangle{}
+		for _, m := range g.Image {
+			bounds = bounds.Union(m.Bounds())
+		}
+	}
+	plan := ss.Plan(bounds)
+	if ss.trim != nil {
+		// every frame has to be trimmed the same, so trim to whatever
+		// isn't border in any of them. frames that are all border
+		// don't count.
+		content := image.Rectangle{}
+		compositeFrames(g, bounds, func(i int, canvas *image.RGBA) {
+			if r, ok := contentRect(canvas, *ss.trim); ok {
+				content = content.Union(r)
+			}
+		})
+		if content.Empty() {
+			content = bounds
+		}
+		plan = ss.planContent(bounds, content)
+	}
+	if plan.Width <= 0 || plan.Height <= 0 {
+		return nil, ErrInvalidSpec
+	}
+
+	out := &gif.GIF{
+		Image:           make([]*image.Paletted, 0, len(g.Image)),
+		Delay:           make([]int, 0, len(g.Image)),
+		Disposal:        make([]byte, 0, len(g.Image)),
+		LoopCount:       g.LoopCount,
+		BackgroundIndex: g.BackgroundIndex,
+		Config: image.Config{
+			ColorModel: g.Config.ColorModel,
+			Width:      plan.Width,
+			Height:     plan.Height,
+		},
+	}
+	compositeFrames(g, bounds, func(i int, canvas *image.RGBA) {
+		resized := resizePlan(canvas, plan)
+		out.Image = append(out.Image, toPaletted(resized, nil, &PaletteOptions{Quantizer: MedianCut{}}))
+		if hasTransparency(resized) {
+			// the next frame has to start from a clear canvas, or these
+			// transparent pixels would show this frame through it
+			out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		} else {
+			out.Disposal = append(out.Disposal, gif.DisposalNone)
+		}
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+	})
+	return out, nil
+}
+
+// compositeFrames draws each frame of g over what came before it, on a
+// canvas with the given bounds, following the disposal methods, and
+// calls fn with the canvas as it is after each frame is drawn
+func compositeFrames(g *gif.GIF, bounds image.Rectangle, fn func(i int, canvas *image.RGBA)) {
+	canvas := image.NewRGBA(bounds)
+	var previous *image.RGBA
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		fn(i, canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+}
+
+// framePalette returns the palette to use for a resized frame and
+// whether the frame has any transparent pixels. If it does and the
+// palette doesn't have a transparent colour, one is added (if there's
+// room).
+func framePalette(pal color.Palette, m image.Image) (color.Palette, bool) {
+	if !hasTransparency(m) {
+		return pal, false
+	}
+	for _, c := range pal {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return pal, true
+		}
+	}
+	if len(pal) < 256 {
+		pal = append(append(color.Palette{}, pal...), color.RGBA{})
+	}
+	return pal, true
+}
+
+func hasTransparency(m image.Image) bool {
+	b := m.Bounds()
+	if rgba, ok := m.(*image.RGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := rgba.Pix[rgba.PixOffset(b.Min.X, y):][:4*b.Dx()]
+			for i := 3; i < len(row); i += 4 {
+				if row[i] == 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+var gifPalette = color.Palette{
+	color.RGBA{0, 0, 0, 0},
+	color.RGBA{255, 0, 0, 255},
+	color.RGBA{0, 0, 255, 255},
+	color.RGBA{0, 255, 0, 255},
+}
+
+func gifFrame(r image.Rectangle, index uint8) *image.Paletted {
+	m := image.NewPaletted(r, gifPalette)
+	for i := range m.Pix {
+		m.Pix[i] = index
+	}
+	return m
+}
+
+// testGIF is 40x20: a red background, then a blue square on the left,
+// then a green square on the right
+func testGIF(disposal byte) *gif.GIF {
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			gifFrame(image.Rect(0, 0, 40, 20), 1),
+			gifFrame(image.Rect(0, 0, 20, 20), 2),
+			gifFrame(image.Rect(20, 0, 40, 20), 3),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, disposal, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{ColorModel: gifPalette, Width: 40, Height: 20},
+	}
+}
+
+func paletteIndexAt(m *image.Paletted, x, y int) color.Color {
+	return m.Palette[m.ColorIndexAt(x, y)]
+}
+
+func Test_ResizeGIF(t *testing.T) {
+	g, err := ResizeGIF(testGIF(gif.DisposalNone), "10w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.LoopCount != 3 || g.Config.Width != 10 || g.Config.Height != 5 {
+		t.Fatal("bad GIF", len(g.Image), g.LoopCount, g.Config)
+	}
+	for i, d := range []int{10, 20, 30} {
+		if g.Delay[i] != d {
+			t.Error("frame", i, "-- bad delay", g.Delay[i])
+		}
+		if g.Image[i].Bounds() != image.Rect(0, 0, 10, 5) {
+			t.Error("frame", i, "-- bad bounds", g.Image[i].Bounds())
+		}
+	}
+	// the last frame should show everything drawn so far
+	last := g.Image[2]
+	if paletteIndexAt(last, 1, 2) != gifPalette[2] || paletteIndexAt(last, 8, 2) != gifPalette[3] {
+		t.Error("frames weren't composited", paletteIndexAt(last, 1, 2), paletteIndexAt(last, 8, 2))
+	}
+
+	// with the blue square disposed to background, the left of the
+	// last frame should be transparent
+	g, _ = ResizeGIF(testGIF(gif.DisposalBackground), "10w")
+	if _, _, _, a := paletteIndexAt(g.Image[2], 1, 2).RGBA(); a != 0 {
+		t.Error("disposal to background wasn't followed", paletteIndexAt(g.Image[2], 1, 2))
+	}
+	if g.Disposal[2] != gif.DisposalBackground {
+		t.Error("frames with transparency should be disposed to background")
+	}
+
+	// and with it disposed to previous, it should be red again
+	g, _ = ResizeGIF(testGIF(gif.DisposalPrevious), "10w")
+	if paletteIndexAt(g.Image[2], 1, 2) != gifPalette[1] {
+		t.Error("disposal to previous wasn't followed", paletteIndexAt(g.Image[2], 1, 2))
+	}
+
+	// a square crop of each frame
+	g, _ = ResizeGIF(testGIF(gif.DisposalNone), "4s")
+	if g.Image[0].Bounds() != image.Rect(0, 0, 4, 4) {
+		t.Error("bad square bounds", g.Image[0].Bounds())
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gif.DecodeAll(&buf); err != nil {
+		t.Error("resized GIF doesn't decode", err)
+	}
+
+	if _, err := ResizeGIF(&gif.GIF{}, "10w"); err != ErrNoFrames {
+		t.Error("expected ErrNoFrames, got", err)
+	}
+}
+
+// solidFrame is a frame of r in c, with a palette of its own that has
+// c in it and no transparent entry
+func solidFrame(r image.Rectangle, c color.Color, pal color.Palette) *image.Paletted {
+	pal = append(color.Palette{c}, pal...)
+	return image.NewPaletted(r, pal)
+}
+
+func Test_ResizeGIFLocalPalettes(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	// a full palette with no transparent entry
+	greys := make(color.Palette, 255)
+	for i := range greys {
+		greys[i] = color.Gray{uint8(i)}
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			solidFrame(image.Rect(0, 0, 40, 20), red, color.Palette{blue}),
+			solidFrame(image.Rect(20, 0, 40, 20), green, color.Palette{color.RGBA{255, 255, 0, 255}}),
+			solidFrame(image.Rect(0, 0, 8, 8), blue, greys),
+		},
+		Delay:    []int{10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 40, Height: 20},
+	}
+	out, err := ResizeGIF(g, "20w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the red from the first frame isn't in the second's palette
+	if c := paletteIndexAt(out.Image[1], 2, 5); c != red {
+		t.Error("colour from an earlier frame was lost", c)
+	}
+	if c := paletteIndexAt(out.Image[1], 15, 5); c != green {
+		t.Error("bad colour for the frame itself", c)
+	}
+	// the third frame's palette is full, but the canvas under it was
+	// disposed to background
+	last := out.Image[2]
+	if c := paletteIndexAt(last, 1, 1); c != blue {
+		t.Error("bad colour for the last frame", c)
+	}
+	if c := paletteIndexAt(last, 5, 8); c != red {
+		t.Error("colour from the first frame was lost", c)
+	}
+	if _, _, _, a := paletteIndexAt(last, 15, 5).RGBA(); a != 0 {
+		t.Error("transparency was lost", paletteIndexAt(last, 15, 5))
+	}
+}
+
+func Test_ResizeGIFTrim(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	black := color.RGBA{0, 0, 0, 255}
+	// a white 100x100 canvas with a black square that moves and grows,
+	// covering 20,20-80,70 between them
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			solidFrame(image.Rect(0, 0, 100, 100), white, color.Palette{black}),
+			solidFrame(image.Rect(20, 20, 50, 40), black, nil),
+			solidFrame(image.Rect(40, 30, 80, 70), black, nil),
+		},
+		Delay:  []int{10, 10, 10},
+		Config: image.Config{Width: 100, Height: 100},
+	}
+	for _, spec := range []string{"trim-30w", "trim-20s"} {
+		out, err := ResizeGIF(g, spec)
+		if err != nil {
+			t.Fatal(spec, err)
+		}
+		for i, m := range out.Image {
+			if m.Bounds() != image.Rect(0, 0, out.Config.Width, out.Config.Height) {
+				t.Error(spec, "frame", i, "-- bounds", m.Bounds(), "don't match", out.Config.Width, out.Config.Height)
+			}
+		}
+		if spec == "trim-30w" && (out.Config.Width != 30 || out.Config.Height != 25) {
+			t.Error(spec, "-- expected 30x25 for the union of the content, got", out.Config.Width, out.Config.Height)
+		}
+		if err := gif.EncodeAll(&bytes.Buffer{}, out); err != nil {
+			t.Error(spec, "-- doesn't encode", err)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/thraxil/resize
+
+go 1.23.0
+
+require golang.org/x/image v0.25.0
@@ -0,0 +1,244 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// ErrUnsupportedProfile is returned for ICC profiles that ConvertToSRGB
+// can't handle. Only RGB matrix/TRC profiles (v2 or v4) are supported,
+// which covers sRGB, Display P3, Adobe RGB, ProPhoto and most other
+// profiles that cameras and editors attach to photos.
+var ErrUnsupportedProfile = errors.New("resize: unsupported ICC profile")
+
+// XYZ (D50) to linear sRGB, with the Bradford adaptation from D65 to D50
+// that ICC profiles are already using. from
+// http://www.brucelindbloom.com/Eqn_RGB_XYZ_Matrix.html
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// iccProfile is the part of a matrix/TRC profile we need: a tone curve
+// per channel (as a lookup table from 8 bit values to linear light) and
+// the matrix from linear RGB to XYZ
+type iccProfile struct {
+	trc    [3][256]float64
+	matrix [3][3]float64
+}
+
+// parseICC reads the matrix and tone curves from an ICC profile
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 {
+		return nil, ErrUnsupportedProfile
+	}
+	be := binary.BigEndian
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, ErrUnsupportedProfile
+	}
+	tags := make(map[string][]byte)
+	n := int(be.Uint32(data[128:]))
+	for i := 0; i < n; i++ {
+		off := 132 + i*12
+		if off+12 > len(data) {
+			return nil, ErrUnsupportedProfile
+		}
+		start := int(be.Uint32(data[off+4:]))
+		size := int(be.Uint32(data[off+8:]))
+		if start < 0 || size < 0 || start+size > len(data) || start+size < start {
+			return nil, ErrUnsupportedProfile
+		}
+		tags[string(data[off:off+4])] = data[start : start+size]
+	}
+
+	p := &iccProfile{}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := parseXYZType(tags[sig])
+		if !ok {
+			return nil, ErrUnsupportedProfile
+		}
+		// colorants are the columns of the matrix
+		for j := 0; j < 3; j++ {
+			p.matrix[j][i] = xyz[j]
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, ok := parseCurve(tags[sig])
+		if !ok {
+			return nil, ErrUnsupportedProfile
+		}
+		for v := 0; v < 256; v++ {
+			p.trc[i][v] = curve(float64(v) / 255)
+		}
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZType(b []byte) ([3]float64, bool) {
+	var xyz [3]float64
+	if len(b) < 20 || string(b[:4]) != "XYZ " {
+		return xyz, false
+	}
+	for i := range xyz {
+		xyz[i] = s15Fixed16(b[8+i*4:])
+	}
+	return xyz, true
+}
+
+// parseCurve returns the tone curve from a curv or para tag as a
+// function from encoded values (0-1) to linear light (0-1)
+func parseCurve(b []byte) (func(float64) float64, bool) {
+	if len(b) < 12 {
+		return nil, false
+	}
+	be := binary.BigEndian
+	switch string(b[:4]) {
+	case "curv":
+		n := int(be.Uint32(b[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1:
+			if len(b) < 14 {
+				return nil, false
+			}
+			g := float64(be.Uint16(b[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case len(b) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(be.Uint16(b[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				pos := x * float64(n-1)
+				i := int(pos)
+				if i >= n-1 {
+					return table[n-1]
+				}
+				f := pos - float64(i)
+				return table[i]*(1-f) + table[i+1]*f
+			}, true
+		}
+	case "para":
+		nparams := []int{1, 3, 4, 5, 7}
+		typ := int(be.Uint16(b[8:]))
+		if typ >= len(nparams) || len(b) < 12+4*nparams[typ] {
+			return nil, false
+		}
+		var p [7]float64
+		for i := 0; i < nparams[typ]; i++ {
+			p[i] = s15Fixed16(b[12+4*i:])
+		}
+		g, a, pb, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		pow := func(x float64) float64 {
+			if x <= 0 {
+				return 0
+			}
+			return math.Pow(x, g)
+		}
+		switch typ {
+		case 0:
+			return pow, true
+		case 1:
+			return func(x float64) float64 { return pow(a*x + pb) }, true
+		case 2:
+			return func(x float64) float64 { return pow(a*x+pb) + c }, true
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(a*x + pb)
+				}
+				return c * x
+			}, true
+		case 4:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(a*x+pb) + e
+				}
+				return c*x + f
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// linear light to 8 bit sRGB, sampled finely enough that rounding
+// in the table doesn't show
+const srgbTableSize = 4096
+
+var srgbEncode = func() [srgbTableSize + 1]uint8 {
+	var t [srgbTableSize + 1]uint8
+	for i := range t {
+		x := float64(i) / srgbTableSize
+		if x <= 0.0031308 {
+			x *= 12.92
+		} else {
+			x = 1.055*math.Pow(x, 1/2.4) - 0.055
+		}
+		t[i] = uint8(math.Round(x * 255))
+	}
+	return t
+}()
+
+func encodeSRGB(x float64) uint8 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 255
+	}
+	return srgbEncode[int(x*srgbTableSize+0.5)]
+}
+
+// ConvertToSRGB returns a copy of m converted from the colour space
+// described by the ICC profile icc to sRGB. If the profile can't be
+// used it returns ErrUnsupportedProfile.
+func ConvertToSRGB(m image.Image, icc []byte) (*image.RGBA, error) {
+	p, err := parseICC(icc)
+	if err != nil {
+		return nil, err
+	}
+	var conv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				conv[i][j] += xyzD50ToSRGB[i][k] * p.matrix[k][j]
+			}
+		}
+	}
+
+	b := m.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), m, b.Min, draw.Src)
+	for y := 0; y < b.Dy(); y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+4*b.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			a := row[i+3]
+			if a == 0 {
+				continue
+			}
+			// RGBA is premultiplied, the curves want straight colour
+			var c [3]uint8
+			for k := 0; k < 3; k++ {
+				c[k] = uint8((uint32(row[i+k])*255 + uint32(a)/2) / uint32(a))
+			}
+			lr, lg, lb := p.trc[0][c[0]], p.trc[1][c[1]], p.trc[2][c[2]]
+			for k := 0; k < 3; k++ {
+				v := encodeSRGB(conv[k][0]*lr + conv[k][1]*lg + conv[k][2]*lb)
+				row[i+k] = uint8((uint32(v)*uint32(a) + 127) / 255)
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,161 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// buildICC makes a minimal RGB matrix/TRC profile from D50 colorants
+// and a curv gamma (or para, if sRGB is true)
+func buildICC(colorants [3][3]float64, gamma float64, srgb bool) []byte {
+	be := binary.BigEndian
+	fixed := func(x float64) []byte {
+		b := make([]byte, 4)
+		be.PutUint32(b, uint32(int32(x*65536)))
+		return b
+	}
+	var tags [][2]interface{}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := append([]byte("XYZ \x00\x00\x00\x00"), fixed(colorants[i][0])...)
+		t = append(t, fixed(colorants[i][1])...)
+		t = append(t, fixed(colorants[i][2])...)
+		tags = append(tags, [2]interface{}{sig, t})
+	}
+	var trc []byte
+	if srgb {
+		trc = []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+		for _, x := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+			trc = append(trc, fixed(x)...)
+		}
+	} else {
+		trc = []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01")
+		trc = append(trc, byte(int(gamma*256)>>8), byte(int(gamma*256)), 0, 0)
+	}
+	for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, [2]interface{}{sig, trc})
+	}
+
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB XYZ ")
+	copy(header[36:], "acsp")
+	table := make([]byte, 4+12*len(tags))
+	be.PutUint32(table, uint32(len(tags)))
+	var data []byte
+	offset := 128 + len(table)
+	for i, t := range tags {
+		b := t[1].([]byte)
+		copy(table[4+12*i:], t[0].(string))
+		be.PutUint32(table[4+12*i+4:], uint32(offset+len(data)))
+		be.PutUint32(table[4+12*i+8:], uint32(len(b)))
+		data = append(data, b...)
+	}
+	out := append(append(header, table...), data...)
+	be.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+var (
+	srgbColorants = [3][3]float64{
+		{0.4360747, 0.2225045, 0.0139322},
+		{0.3850649, 0.7168786, 0.0971045},
+		{0.1430804, 0.0606169, 0.7141733},
+	}
+	adobeColorants = [3][3]float64{
+		{0.6097559, 0.3111242, 0.0194811},
+		{0.2052401, 0.6256560, 0.0608902},
+		{0.1492240, 0.0632197, 0.7448387},
+	}
+)
+
+func solid(c color.Color) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			m.Set(x, y, c)
+		}
+	}
+	return m
+}
+
+func near(a, b uint8, d int) bool {
+	x := int(a) - int(b)
+	return x >= -d && x <= d
+}
+
+func Test_ConvertToSRGB(t *testing.T) {
+	// an sRGB profile should be (very nearly) a no-op
+	srgb := buildICC(srgbColorants, 0, true)
+	for _, c := range []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}, {200, 100, 50, 255}, {10, 240, 130, 255}, {60, 30, 10, 128}} {
+		out, err := ConvertToSRGB(solid(c), srgb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := out.RGBAAt(1, 1)
+		if !near(got.R, c.R, 2) || !near(got.G, c.G, 2) || !near(got.B, c.B, 2) || got.A != c.A {
+			t.Error("sRGB -> sRGB changed", c, "to", got)
+		}
+	}
+
+	adobe := buildICC(adobeColorants, 2.2, false)
+	// greys stay grey
+	out, err := ConvertToSRGB(solid(color.RGBA{128, 128, 128, 255}), adobe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := out.RGBAAt(0, 0)
+	if !near(g.R, g.G, 1) || !near(g.G, g.B, 1) || !near(g.R, 129, 2) {
+		t.Error("Adobe RGB grey should stay grey", g)
+	}
+	// Adobe RGB is a wider gamut, so the same numbers in sRGB are
+	// a more saturated colour
+	out, _ = ConvertToSRGB(solid(color.RGBA{100, 200, 100, 255}), adobe)
+	g = out.RGBAAt(0, 0)
+	if g.G <= 200 && g.R >= 100 {
+		t.Error("Adobe RGB green should get more saturated", g)
+	}
+
+	if _, err := ConvertToSRGB(solid(color.White), []byte("nonsense")); err != ErrUnsupportedProfile {
+		t.Error("expected ErrUnsupportedProfile, got", err)
+	}
+	cmyk := buildICC(srgbColorants, 0, true)
+	copy(cmyk[16:], "CMYK")
+	if _, err := ConvertToSRGB(solid(color.White), cmyk); err != ErrUnsupportedProfile {
+		t.Error("expected ErrUnsupportedProfile for CMYK, got", err)
+	}
+}
+
+func Test_ColorManage(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, solid(color.RGBA{100, 200, 100, 255}), &jpeg.Options{Quality: 100})
+	jpg := embedMetadata(buf.Bytes(), "jpeg", &metadata{icc: buildICC(adobeColorants, 2.2, false)})
+
+	var out bytes.Buffer
+	res, err := ResizeStream(&out, bytes.NewReader(jpg), "full", &Options{ColorManage: true, Metadata: MetadataKeepICC, Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 0 {
+		t.Error("unexpected warnings", res.Warnings)
+	}
+	if readMetadata(out.Bytes(), "png", allMetadata).icc != nil {
+		t.Error("profile should be dropped once the image is sRGB")
+	}
+
+	bad := embedMetadata(buf.Bytes(), "jpeg", &metadata{icc: []byte("not really a profile")})
+	out.Reset()
+	res, err = ResizeStream(&out, bytes.NewReader(bad), "full", &Options{ColorManage: true, Metadata: MetadataKeepICC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 1 {
+		t.Error("expected a warning for a bad profile", res.Warnings)
+	}
+	if readMetadata(out.Bytes(), "jpeg", allMetadata).icc == nil {
+		t.Error("profile should be kept if it couldn't be applied")
+	}
+}
@@ -0,0 +1,573 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+// a minimal baseline JPEG decoder that only ever decodes at 1/2, 1/4
+// or 1/8 scale. each 8x8 block of DCT coefficients is turned straight
+// into a 4x4, 2x2 or 1x1 block of pixels using just the low frequency
+// coefficients, so a big photo never has to exist at full size in
+// memory. the high frequency coefficients still have to be huffman
+// decoded to get past them, but the expensive part, the IDCT, mostly
+// goes away.
+//
+// only what phones and cameras actually write is handled: 8 bit
+// baseline or extended sequential huffman, greyscale or YCbCr.
+// anything else (progressive, arithmetic coding, CMYK, ...) returns
+// errJPEGUnsupported, and the caller falls back to image/jpeg.
+
+var errJPEGUnsupported = errors.New("resize: JPEG not supported for scaled decoding")
+var errJPEGCorrupt = errors.New("resize: corrupt JPEG")
+
+// jpegZigzag maps the position of a coefficient in the entropy coded
+// data to its position in the 8x8 block
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+type huffTable struct {
+	// lut decodes codes of up to 8 bits in one go: length<<8 | value,
+	// or 0 for longer codes
+	lut     [256]uint16
+	maxcode [17]int32
+	valptr  [17]int32
+	mincode [17]int32
+	vals    []byte
+}
+
+// buildHuffTable returns errJPEGCorrupt if counts has more codes of
+// some length than there's room for
+func buildHuffTable(counts []byte, vals []byte) (*huffTable, error) {
+	t := &huffTable{vals: vals}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		if code+n > 1<<uint(l) {
+			return nil, errJPEGCorrupt
+		}
+		t.valptr[l] = k
+		t.mincode[l] = code
+		if n == 0 {
+			t.maxcode[l] = -1
+		} else {
+			t.maxcode[l] = code + n - 1
+		}
+		if l <= 8 {
+			for i := int32(0); i < n; i++ {
+				c := (code + i) << uint(8-l)
+				for fill := int32(0); fill < 1<<uint(8-l); fill++ {
+					t.lut[c|fill] = uint16(l)<<8 | uint16(vals[k+i])
+				}
+			}
+		}
+		code += n
+		k += n
+		code <<= 1
+	}
+	return t, nil
+}
+
+// bitReader reads entropy coded data, taking care of byte stuffing.
+// when it hits a marker it pads with zeros rather than reading past it.
+type bitReader struct {
+	data []byte
+	pos  int
+	acc  uint32
+	n    uint
+}
+
+func (self *bitReader) fill() {
+	for self.n <= 24 {
+		var b byte
+		if self.pos < len(self.data) {
+			b = self.data[self.pos]
+			if b == 0xff {
+				if self.pos+1 < len(self.data) && self.data[self.pos+1] == 0 {
+					self.pos += 2
+				} else {
+					// a marker
+					b = 0
+				}
+			} else {
+				self.pos++
+			}
+		}
+		self.acc |= uint32(b) << (24 - self.n)
+		self.n += 8
+	}
+}
+
+func (self *bitReader) bits(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	if self.n < n {
+		self.fill()
+	}
+	v := int32(self.acc >> (32 - n))
+	self.acc <<= n
+	self.n -= n
+	return v
+}
+
+// receive reads an n bit value and sign extends it
+func (self *bitReader) receive(n uint) int32 {
+	v := self.bits(n)
+	if n > 0 && v < 1<<(n-1) {
+		v += -1<<n + 1
+	}
+	return v
+}
+
+func (self *bitReader) decode(t *huffTable) (byte, error) {
+	if self.n < 16 {
+		self.fill()
+	}
+	if v := t.lut[self.acc>>24]; v != 0 {
+		l := uint(v >> 8)
+		self.acc <<= l
+		self.n -= l
+		return byte(v), nil
+	}
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | self.bits(1)
+		if code <= t.maxcode[l] {
+			return t.vals[t.valptr[l]+code-t.mincode[l]], nil
+		}
+	}
+	return 0, errJPEGCorrupt
+}
+
+// restart skips over an RSTn marker and starts reading bits afresh
+func (self *bitReader) restart() {
+	self.acc, self.n = 0, 0
+	for self.pos < len(self.data) && self.data[self.pos] == 0xff {
+		self.pos++
+	}
+	if self.pos < len(self.data) && self.data[self.pos] >= 0xd0 && self.data[self.pos] <= 0xd7 {
+		self.pos++
+	}
+}
+
+// skipToMarker moves past the rest of the entropy coded data
+func (self *bitReader) skipToMarker() int {
+	p := self.pos
+	for p+1 < len(self.data) {
+		if self.data[p] == 0xff && self.data[p+1] != 0 && (self.data[p+1] < 0xd0 || self.data[p+1] > 0xd7) {
+			return p
+		}
+		p++
+	}
+	return len(self.data)
+}
+
+type jpegComponent struct {
+	id     byte
+	h, v   int
+	tq     int
+	td, ta int
+	pred   int32
+	// the component, decoded at the reduced scale, padded out to
+	// whole MCUs
+	plane  []byte
+	stride int
+}
+
+// idctTables[n] has C(u) * cos((2x+1)uπ/2n) for an n point output
+var idctTables = func() map[int][][]float32 {
+	tables := make(map[int][][]float32)
+	for _, n := range []int{1, 2, 4} {
+		t := make([][]float32, n)
+		for x := range t {
+			t[x] = make([]float32, n)
+			for u := range t[x] {
+				c := 1.0
+				if u == 0 {
+					c = 1 / math.Sqrt2
+				}
+				t[x][u] = float32(c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n)))
+			}
+		}
+		tables[n] = t
+	}
+	return tables
+}()
+
+// decodeJPEGScaled decodes a baseline JPEG at 1/scale of its full size,
+// where scale is 2, 4 or 8. The result is an *image.Gray or an
+// *image.YCbCr.
+func decodeJPEGScaled(data []byte, scale int) (image.Image, error) {
+	n := 8 / scale
+	table, ok := idctTables[n]
+	if !ok || scale*n != 8 {
+		return nil, errJPEGUnsupported
+	}
+	var (
+		quant      [4][64]int32
+		dcTables   [4]*huffTable
+		acTables   [4]*huffTable
+		comps      []*jpegComponent
+		width      int
+		height     int
+		hmax, vmax = 1, 1
+		restart    int
+		mcusX      int
+		mcusY      int
+		sawFrame   bool
+		sawScan    bool
+		adobeRGB   bool
+	)
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errJPEGCorrupt
+	}
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] == 0xff && pos+1 < len(data) && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+2 > len(data) || data[pos] != 0xff {
+			if sawScan {
+				break
+			}
+			return nil, errJPEGCorrupt
+		}
+		marker := data[pos+1]
+		pos += 2
+		if marker == 0xd9 {
+			break
+		}
+		if marker >= 0xd0 && marker <= 0xd7 || marker == 0x01 {
+			continue
+		}
+		if pos+2 > len(data) {
+			return nil, errJPEGCorrupt
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, errJPEGCorrupt
+		}
+		seg := data[pos+2 : pos+length]
+		pos += length
+
+		switch {
+		case marker == 0xc0 || marker == 0xc1:
+			if sawFrame || len(seg) < 6 || seg[0] != 8 {
+				return nil, errJPEGUnsupported
+			}
+			height = int(binary.BigEndian.Uint16(seg[1:]))
+			width = int(binary.BigEndian.Uint16(seg[3:]))
+			nf := int(seg[5])
+			if (nf != 1 && nf != 3) || len(seg) < 6+3*nf || width == 0 || height == 0 {
+				return nil, errJPEGUnsupported
+			}
+			for i := 0; i < nf; i++ {
+				c := &jpegComponent{id: seg[6+3*i], h: int(seg[7+3*i] >> 4), v: int(seg[7+3*i] & 15), tq: int(seg[8+3*i])}
+				if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 || c.tq > 3 {
+					return nil, errJPEGCorrupt
+				}
+				if nf == 1 {
+					// a single component is never interleaved, so
+					// sampling factors don't mean anything
+					c.h, c.v = 1, 1
+				}
+				if c.h > hmax {
+					hmax = c.h
+				}
+				if c.v > vmax {
+					vmax = c.v
+				}
+				comps = append(comps, c)
+			}
+			if nf == 3 && (comps[1].h != 1 || comps[1].v != 1 || comps[2].h != 1 || comps[2].v != 1) {
+				// only luma can be subsampled relative to chroma
+				return nil, errJPEGUnsupported
+			}
+			if nf == 3 && comps[0].id == 'R' && comps[1].id == 'G' && comps[2].id == 'B' {
+				return nil, errJPEGUnsupported
+			}
+			mcusX = (width + 8*hmax - 1) / (8 * hmax)
+			mcusY = (height + 8*vmax - 1) / (8 * vmax)
+			for _, c := range comps {
+				c.stride = mcusX * c.h * n
+				c.plane = make([]byte, c.stride*mcusY*c.v*n)
+			}
+			sawFrame = true
+		case marker >= 0xc2 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// progressive, lossless, arithmetic, ...
+			return nil, errJPEGUnsupported
+		case marker == 0xee:
+			// an Adobe segment that says the colours aren't YCbCr
+			if len(seg) >= 12 && string(seg[:5]) == "Adobe" && seg[11] == 0 {
+				adobeRGB = true
+			}
+		case marker == 0xdb:
+			for len(seg) > 0 {
+				pq, tq := seg[0]>>4, int(seg[0]&15)
+				if tq > 3 {
+					return nil, errJPEGCorrupt
+				}
+				size := 64
+				if pq == 1 {
+					size = 128
+				}
+				if len(seg) < 1+size {
+					return nil, errJPEGCorrupt
+				}
+				for k := 0; k < 64; k++ {
+					if pq == 1 {
+						quant[tq][k] = int32(binary.BigEndian.Uint16(seg[1+2*k:]))
+					} else {
+						quant[tq][k] = int32(seg[1+k])
+					}
+				}
+				seg = seg[1+size:]
+			}
+		case marker == 0xc4:
+			for len(seg) > 0 {
+				if len(seg) < 17 {
+					return nil, errJPEGCorrupt
+				}
+				tc, th := seg[0]>>4, int(seg[0]&15)
+				total := 0
+				for _, c := range seg[1:17] {
+					total += int(c)
+				}
+				if th > 3 || tc > 1 || total > 256 || len(seg) < 17+total {
+					return nil, errJPEGCorrupt
+				}
+				t, err := buildHuffTable(seg[1:17], seg[17:17+total])
+				if err != nil {
+					return nil, err
+				}
+				if tc == 0 {
+					dcTables[th] = t
+				} else {
+					acTables[th] = t
+				}
+				seg = seg[17+total:]
+			}
+		case marker == 0xdd:
+			if len(seg) < 2 {
+				return nil, errJPEGCorrupt
+			}
+			restart = int(binary.BigEndian.Uint16(seg))
+		case marker == 0xda:
+			if !sawFrame || len(seg) < 1 {
+				return nil, errJPEGCorrupt
+			}
+			if adobeRGB && len(comps) == 3 {
+				return nil, errJPEGUnsupported
+			}
+			ns := int(seg[0])
+			if ns < 1 || len(seg) < 1+2*ns+3 {
+				return nil, errJPEGCorrupt
+			}
+			var scan []*jpegComponent
+			for i := 0; i < ns; i++ {
+				id, tables := seg[1+2*i], seg[2+2*i]
+				var c *jpegComponent
+				for _, fc := range comps {
+					if fc.id == id {
+						c = fc
+					}
+				}
+				if c == nil {
+					return nil, errJPEGCorrupt
+				}
+				c.td, c.ta = int(tables>>4), int(tables&15)
+				if c.td > 3 || c.ta > 3 || dcTables[c.td] == nil || acTables[c.ta] == nil {
+					return nil, errJPEGCorrupt
+				}
+				c.pred = 0
+				scan = append(scan, c)
+			}
+			br := &bitReader{data: data, pos: pos}
+			if err := decodeScan(br, scan, mcusX, mcusY, hmax, vmax, width, height, restart, n, table, &quant, &dcTables, &acTables); err != nil {
+				return nil, err
+			}
+			pos = br.skipToMarker()
+			sawScan = true
+		}
+	}
+	if !sawScan {
+		return nil, errJPEGCorrupt
+	}
+
+	w, h := (width+scale-1)/scale, (height+scale-1)/scale
+	r := image.Rect(0, 0, w, h)
+	if len(comps) == 1 {
+		m := image.NewGray(r)
+		c := comps[0]
+		for y := 0; y < h; y++ {
+			copy(m.Pix[y*m.Stride:y*m.Stride+w], c.plane[y*c.stride:])
+		}
+		return m, nil
+	}
+	var ratio image.YCbCrSubsampleRatio
+	switch [2]int{hmax, vmax} {
+	case [2]int{1, 1}:
+		ratio = image.YCbCrSubsampleRatio444
+	case [2]int{2, 1}:
+		ratio = image.YCbCrSubsampleRatio422
+	case [2]int{2, 2}:
+		ratio = image.YCbCrSubsampleRatio420
+	case [2]int{1, 2}:
+		ratio = image.YCbCrSubsampleRatio440
+	case [2]int{4, 1}:
+		ratio = image.YCbCrSubsampleRatio411
+	case [2]int{4, 2}:
+		ratio = image.YCbCrSubsampleRatio410
+	default:
+		return nil, errJPEGUnsupported
+	}
+	m := image.NewYCbCr(r, ratio)
+	for y := 0; y < h; y++ {
+		copy(m.Y[y*m.YStride:y*m.YStride+w], comps[0].plane[y*comps[0].stride:])
+	}
+	cw, ch := (w+hmax-1)/hmax, (h+vmax-1)/vmax
+	for y := 0; y < ch; y++ {
+		copy(m.Cb[y*m.CStride:y*m.CStride+cw], comps[1].plane[y*comps[1].stride:])
+		copy(m.Cr[y*m.CStride:y*m.CStride+cw], comps[2].plane[y*comps[2].stride:])
+	}
+	return m, nil
+}
+
+// decodeScan decodes the blocks of one scan into the components' planes
+func decodeScan(br *bitReader, scan []*jpegComponent, mcusX, mcusY, hmax, vmax, width, height, restart, n int,
+	table [][]float32, quant *[4][64]int32, dcTables, acTables *[4]*huffTable) error {
+	var coef [64]float32
+	block := func(c *jpegComponent, bx, by int) error {
+		for i := range coef {
+			coef[i] = 0
+		}
+		q := &quant[c.tq]
+		t, err := br.decode(dcTables[c.td])
+		if err != nil {
+			return err
+		}
+		if t > 16 {
+			return errJPEGCorrupt
+		}
+		c.pred += br.receive(uint(t))
+		coef[0] = float32(c.pred * q[0])
+		ac := acTables[c.ta]
+		for k := 1; k < 64; {
+			rs, err := br.decode(ac)
+			if err != nil {
+				return err
+			}
+			r, s := int(rs>>4), uint(rs&15)
+			if s == 0 {
+				if r != 15 {
+					break
+				}
+				k += 16
+				continue
+			}
+			k += r
+			if k > 63 {
+				return errJPEGCorrupt
+			}
+			v := br.receive(s)
+			if z := jpegZigzag[k]; z%8 < n && z/8 < n {
+				coef[z] = float32(v * q[k])
+			}
+			k++
+		}
+		scaledIDCT(&coef, n, table, c.plane[by*n*c.stride+bx*n:], c.stride)
+		return nil
+	}
+
+	count := 0
+	next := func() {
+		count++
+		if restart > 0 && count%restart == 0 {
+			br.restart()
+			for _, c := range scan {
+				c.pred = 0
+			}
+		}
+	}
+	if len(scan) == 1 {
+		// not interleaved, the blocks just cover the component
+		c := scan[0]
+		cw := (width*c.h + hmax - 1) / hmax
+		ch := (height*c.v + vmax - 1) / vmax
+		bw, bh := (cw+7)/8, (ch+7)/8
+		for by := 0; by < bh; by++ {
+			for bx := 0; bx < bw; bx++ {
+				if err := block(c, bx, by); err != nil {
+					return err
+				}
+				next()
+			}
+		}
+		return nil
+	}
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			for _, c := range scan {
+				for v := 0; v < c.v; v++ {
+					for h := 0; h < c.h; h++ {
+						if err := block(c, mx*c.h+h, my*c.v+v); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			next()
+		}
+	}
+	return nil
+}
+
+// scaledIDCT turns the low frequency n*n coefficients of a block into
+// n*n pixels written to out
+func scaledIDCT(coef *[64]float32, n int, table [][]float32, out []byte, stride int) {
+	if n == 1 {
+		out[0] = clampPixel(coef[0]/8 + 128)
+		return
+	}
+	var tmp [4][4]float32
+	// rows: tmp[v][x] is the sum over u
+	for v := 0; v < n; v++ {
+		for x := 0; x < n; x++ {
+			var s float32
+			for u := 0; u < n; u++ {
+				s += table[x][u] * coef[v*8+u]
+			}
+			tmp[v][x] = s
+		}
+	}
+	// then columns
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			var s float32
+			for v := 0; v < n; v++ {
+				s += table[y][v] * tmp[v][x]
+			}
+			out[y*stride+x] = clampPixel(s/4 + 128)
+		}
+	}
+}
+
+func clampPixel(v float32) byte {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return byte(v + 0.5)
+}
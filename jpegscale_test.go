@@ -0,0 +1,220 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// smoothImage is something a JPEG encoder won't mangle too much,
+// so the differences are down to the decoding
+func smoothImage(w, h int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.Set(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x + y) * 128 / (w + h)), 255})
+		}
+	}
+	return m
+}
+
+// meanDifference compares two images of the same size
+func meanDifference(a, b image.Image) float64 {
+	r := a.Bounds()
+	total := 0.0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c1 := color.RGBAModel.Convert(a.At(x, y)).(color.RGBA)
+			c2 := color.RGBAModel.Convert(b.At(x-r.Min.X+b.Bounds().Min.X, y-r.Min.Y+b.Bounds().Min.Y)).(color.RGBA)
+			for _, d := range []int{int(c1.R) - int(c2.R), int(c1.G) - int(c2.G), int(c1.B) - int(c2.B)} {
+				if d < 0 {
+					d = -d
+				}
+				total += float64(d)
+			}
+		}
+	}
+	return total / float64(3*r.Dx()*r.Dy())
+}
+
+func Test_DecodeJPEGScaled(t *testing.T) {
+	sources := map[string]image.Image{
+		"colour": smoothImage(256, 192),
+		"odd":    smoothImage(101, 77),
+		"grey": func() image.Image {
+			m := image.NewGray(image.Rect(0, 0, 120, 90))
+			for i := range m.Pix {
+				m.Pix[i] = uint8(i % 120 * 2)
+			}
+			return m
+		}(),
+	}
+	for name, src := range sources {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		full, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, scale := range []int{2, 4, 8} {
+			m, err := decodeJPEGScaled(buf.Bytes(), scale)
+			if err != nil {
+				t.Fatal(name, scale, err)
+			}
+			b := src.Bounds()
+			want := image.Rect(0, 0, (b.Dx()+scale-1)/scale, (b.Dy()+scale-1)/scale)
+			if m.Bounds() != want {
+				t.Error(name, scale, "-- bad bounds", m.Bounds(), "expected", want)
+				continue
+			}
+			if _, ok := full.(*image.Gray); ok {
+				if _, ok := m.(*image.Gray); !ok {
+					t.Errorf("%s %d -- expected a grey image, got %T", name, scale, m)
+				}
+			}
+			// the same as decoding at full size and shrinking, near enough.
+			// subsampled chroma ends up at half the output resolution, which
+			// shows most on steep gradients at 1/8
+			limit := 4.0
+			if scale == 8 {
+				limit = 8
+			}
+			shrunk := shrinkBy(full, scale)
+			if d := meanDifference(m, shrunk); d > limit {
+				t.Error(name, scale, "-- too different from a full decode", d)
+			}
+		}
+	}
+}
+
+// shrinkBy averages each scale*scale block of m, clipped to its bounds
+func shrinkBy(m image.Image, scale int) image.Image {
+	b := m.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, (b.Dx()+scale-1)/scale, (b.Dy()+scale-1)/scale))
+	for y := 0; y < out.Bounds().Dy(); y++ {
+		for x := 0; x < out.Bounds().Dx(); x++ {
+			var sum [3]uint32
+			n := uint32(0)
+			for sy := y * scale; sy < (y+1)*scale && sy < b.Dy(); sy++ {
+				for sx := x * scale; sx < (x+1)*scale && sx < b.Dx(); sx++ {
+					c := color.RGBAModel.Convert(m.At(b.Min.X+sx, b.Min.Y+sy)).(color.RGBA)
+					sum[0] += uint32(c.R)
+					sum[1] += uint32(c.G)
+					sum[2] += uint32(c.B)
+					n++
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 255})
+		}
+	}
+	return out
+}
+
+func Test_ShrinkScale(t *testing.T) {
+	bounds := image.Rect(0, 0, 6000, 4000)
+	cases := []struct {
+		specs  []string
+		margin float64
+		scale  int
+	}{
+		{[]string{"100s"}, 0, 8},
+		{[]string{"1000w"}, 0, 2},
+		{[]string{"1000w"}, 1, 4},
+		{[]string{"2000w"}, 0, 1},
+		{[]string{"full"}, 0, 1},
+		{[]string{"100s", "1000w"}, 0, 2},
+		{[]string{"crop:0,0,800,800-100s"}, 0, 4},
+	}
+	for _, c := range cases {
+		var specs []*SizeSpec
+		for _, s := range c.specs {
+			specs = append(specs, MakeSizeSpec(s))
+		}
+		if r := shrinkScale(bounds, specs, &Options{ShrinkMargin: c.margin}); r != c.scale {
+			t.Error(c.specs, c.margin, "-- expected scale", c.scale, "got", r)
+		}
+	}
+}
+
+func Test_ShrinkOnLoad(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, smoothImage(1200, 800), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	rotated := withSegment(plain, exifSegment(binary.BigEndian, OrientationRotate90))
+
+	// make sure the scaled decoder is actually being used
+	src, err := decodeOriented(bytes.NewReader(rotated), []*SizeSpec{MakeSizeSpec("100s")}, &Options{ShrinkOnLoad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.scale != 4 || src.image.Bounds() != image.Rect(0, 0, 200, 300) || src.bounds != image.Rect(0, 0, 800, 1200) {
+		t.Error("expected a quarter size decode, got scale", src.scale, src.image.Bounds(), src.bounds)
+	}
+
+	for _, c := range []struct {
+		jpg  []byte
+		spec string
+	}{
+		{plain, "100s"},
+		{plain, "150w"},
+		{plain, "crop:600,400,400,300-50w"},
+		{plain, "full"},
+		{rotated, "100w"},
+		{rotated, "crop:0,0,800,400-100w"},
+	} {
+		var full, shrunk bytes.Buffer
+		want, err := ResizeStream(&full, bytes.NewReader(c.jpg), c.spec, &Options{Format: "png"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ResizeStream(&shrunk, bytes.NewReader(c.jpg), c.spec, &Options{Format: "png", ShrinkOnLoad: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Width != want.Width || got.Height != want.Height {
+			t.Error(c.spec, "-- shrinking changed the size", got.Width, got.Height, "expected", want.Width, want.Height)
+			continue
+		}
+		a, _ := png.Decode(&full)
+		b, _ := png.Decode(&shrunk)
+		if d := meanDifference(a, b); d > 4 {
+			t.Error(c.spec, "-- too different from a full decode", d)
+		}
+	}
+}
+
+func Test_DecodeJPEGScaledCorruptHuffman(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, smoothImage(64, 64), nil); err != nil {
+		t.Fatal(err)
+	}
+	jpg := buf.Bytes()
+	i := bytes.Index(jpg, []byte{0xff, 0xc4})
+	if i < 0 {
+		t.Fatal("no DHT segment")
+	}
+	// three codes of length 1, when there's only room for two. the
+	// total stays the same, so only the counts are wrong
+	counts := jpg[i+5 : i+21]
+	if counts[2] < 3 {
+		t.Fatal("unexpected huffman table", counts)
+	}
+	counts[0] += 3
+	counts[2] -= 3
+
+	if _, err := decodeJPEGScaled(jpg, 8); err != errJPEGCorrupt {
+		t.Error("expected errJPEGCorrupt, got", err)
+	}
+	var out bytes.Buffer
+	if _, err := ResizeStream(&out, bytes.NewReader(jpg), "8s", &Options{ShrinkOnLoad: true}); err == nil {
+		t.Error("expected an error resizing a corrupt JPEG")
+	}
+}
@@ -0,0 +1,145 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// ErrLimitExceeded is what a *LimitError unwraps to, so
+// errors.Is(err, ErrLimitExceeded) catches any of the limits.
+var ErrLimitExceeded = errors.New("resize: limit exceeded")
+
+// LimitError is returned when an image goes over one of the Limits.
+type LimitError struct {
+	// Limit is which limit it was: "input bytes", "source pixels",
+	// "output pixels" or "memory".
+	Limit string
+	// Value is what the image needed and Max is what was allowed.
+	Value int64
+	Max   int64
+}
+
+func (self *LimitError) Error() string {
+	return fmt.Sprintf("resize: %s limit exceeded (%d > %d)", self.Limit, self.Value, self.Max)
+}
+
+func (self *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// Limits protect against images that would take too much memory to
+// decode or resize, like a tiny PNG that claims to be 50000x50000.
+// Zero means no limit, and so does a nil *Limits.
+//
+// The memory estimate covers the encoded input, the decoded source and
+// the buffers the resize needs. It's only an estimate, but it's on the
+// high side.
+type Limits struct {
+	// MaxInputBytes is the most bytes of encoded image that are read.
+	MaxInputBytes int64
+	// MaxSourcePixels is the most pixels the source can have.
+	MaxSourcePixels int64
+	// MaxOutputPixels is the most pixels the output can have.
+	MaxOutputPixels int64
+	// MaxMemory is the most bytes decoding and resizing can
+	// be expected to allocate.
+	MaxMemory int64
+}
+
+// CheckConfig checks an image's header, as returned by
+// image.DecodeConfig, before it's decoded.
+func (self *Limits) CheckConfig(cfg image.Config) error {
+	if self == nil {
+		return nil
+	}
+	if err := check("source pixels", int64(cfg.Width)*int64(cfg.Height), self.MaxSourcePixels); err != nil {
+		return err
+	}
+	return check("memory", decodedSize(cfg), self.MaxMemory)
+}
+
+// CheckPlan checks a resize before anything is allocated for it.
+func (self *Limits) CheckPlan(plan ResizePlan) error {
+	if self == nil {
+		return nil
+	}
+	if err := check("output pixels", int64(plan.Width)*int64(plan.Height), self.MaxOutputPixels); err != nil {
+		return err
+	}
+	// assume the source is 4 bytes a pixel, since it hasn't
+	// necessarily been decoded yet
+	src := 4 * int64(plan.Source.Dx()) * int64(plan.Source.Dy())
+	return check("memory", src+planMemory(plan), self.MaxMemory)
+}
+
+// readInput reads all of r, stopping as soon as it's read more than
+// MaxInputBytes, or MaxMemory, as the input alone would be too much
+func (self *Limits) readInput(r io.Reader) ([]byte, error) {
+	if self == nil {
+		return io.ReadAll(r)
+	}
+	limit, max := "input bytes", self.MaxInputBytes
+	if self.MaxMemory > 0 && (max <= 0 || self.MaxMemory < max) {
+		limit, max = "memory", self.MaxMemory
+	}
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, &LimitError{Limit: limit, Value: int64(len(data)), Max: max}
+	}
+	return data, nil
+}
+
+// checkInput checks the memory needed for the decoded image along with
+// held bytes that are kept while it's decoded, like the encoded input
+func (self *Limits) checkInput(cfg image.Config, held int64) error {
+	if self == nil {
+		return nil
+	}
+	return check("memory", decodedSize(cfg)+held, self.MaxMemory)
+}
+
+func check(limit string, value, max int64) error {
+	if max > 0 && value > max {
+		return &LimitError{Limit: limit, Value: value, Max: max}
+	}
+	return nil
+}
+
+// planMemory is how many bytes resizeBox allocates for a plan: the
+// sums, a row of the source and the output
+func planMemory(plan ResizePlan) int64 {
+	w, h := int64(plan.Width), int64(plan.Height)
+	return 4*8*w*h + 4*8*int64(plan.Crop.Dx()) + 4*w*h
+}
+
+// decodedSize estimates the bytes an image will take once it's decoded
+func decodedSize(cfg image.Config) int64 {
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	switch cfg.ColorModel {
+	case color.GrayModel, color.AlphaModel:
+		return pixels
+	case color.Gray16Model, color.Alpha16Model:
+		return 2 * pixels
+	case color.YCbCrModel:
+		// without subsampling, which is the worst case
+		return 3 * pixels
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8 * pixels
+	}
+	if _, ok := cfg.ColorModel.(color.Palette); ok {
+		return pixels
+	}
+	return 4 * pixels
+}
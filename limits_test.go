@@ -0,0 +1,122 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// bombPNG is just the header of a PNG claiming to be w*h
+func bombPNG(w, h int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(w))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+	writePNGChunk(&buf, "IHDR", ihdr)
+	writePNGChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func Test_Limits(t *testing.T) {
+	limits := &Limits{MaxSourcePixels: 1000000, MaxOutputPixels: 10000, MaxMemory: 10 << 20}
+	rgba := func(w, h int) image.Config {
+		return image.Config{ColorModel: color.RGBAModel, Width: w, Height: h}
+	}
+	cases := []struct {
+		cfg   image.Config
+		spec  string
+		limit string
+	}{
+		{rgba(1000, 1000), "100s", ""},
+		{rgba(1001, 1000), "100s", "source pixels"},
+		{rgba(1000, 1000), "101s", "output pixels"},
+		{rgba(1000, 1000), "200w", "output pixels"},
+		{rgba(50000, 50000), "100s", "source pixels"},
+		// 8MB decoded
+		{image.Config{ColorModel: color.RGBA64Model, Width: 1000, Height: 1000}, "100s", ""},
+	}
+	for _, c := range cases {
+		err := limits.CheckConfig(c.cfg)
+		if err == nil {
+			err = limits.CheckPlan(MakeSizeSpec(c.spec).Plan(image.Rect(0, 0, c.cfg.Width, c.cfg.Height)))
+		}
+		if c.limit == "" {
+			if err != nil {
+				t.Error(c.cfg.Width, c.cfg.Height, c.spec, "-- unexpected error", err)
+			}
+			continue
+		}
+		var le *LimitError
+		if !errors.As(err, &le) || le.Limit != c.limit || !errors.Is(err, ErrLimitExceeded) {
+			t.Error(c.cfg.Width, c.cfg.Height, c.spec, "-- expected the", c.limit, "limit, got", err)
+		}
+	}
+
+	// memory on its own
+	small := &Limits{MaxMemory: 1 << 20}
+	if err := small.CheckConfig(image.Config{ColorModel: color.GrayModel, Width: 1024, Height: 1024}); err != nil {
+		t.Error("grey should fit in a megabyte", err)
+	}
+	if err := small.CheckConfig(rgba(1024, 1024)); !errors.Is(err, ErrLimitExceeded) {
+		t.Error("RGBA shouldn't fit in a megabyte", err)
+	}
+	if err := small.CheckPlan(MakeSizeSpec("400s").Plan(image.Rect(0, 0, 10, 10))); !errors.Is(err, ErrLimitExceeded) {
+		t.Error("400x400 of sums shouldn't fit in a megabyte", err)
+	}
+
+	// nil is no limits
+	var none *Limits
+	if none.CheckConfig(rgba(50000, 50000)) != nil || none.CheckPlan(MakeSizeSpec("50000s").Plan(image.Rect(0, 0, 1, 1))) != nil {
+		t.Error("nil limits should allow anything")
+	}
+}
+
+func Test_StreamLimits(t *testing.T) {
+	opts := &Options{Limits: &Limits{MaxSourcePixels: 10000000}}
+	// nothing gets decoded, so this would fail anyway, but not
+	// with a LimitError
+	_, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(bombPNG(50000, 50000)), "100s", opts)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Error("expected the bomb to be stopped, got", err)
+	}
+
+	jpg := testJPEG(t, 40, 20)
+	opts = &Options{Limits: &Limits{MaxOutputPixels: 400}}
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "20s", opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "21s", opts); !errors.Is(err, ErrLimitExceeded) {
+		t.Error("expected the output limit to be hit, got", err)
+	}
+	// the encoded input counts too
+	opts = &Options{Limits: &Limits{MaxInputBytes: int64(len(jpg)) - 1}}
+	var le *LimitError
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "10s", opts); !errors.As(err, &le) || le.Limit != "input bytes" {
+		t.Error("expected the input limit to be hit, got", err)
+	}
+	opts.Limits.MaxInputBytes = int64(len(jpg))
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "10s", opts); err != nil {
+		t.Error(err)
+	}
+	// 40x20 decodes to 2400 bytes, which fits without the input
+	opts = &Options{Limits: &Limits{MaxMemory: 2400 + int64(len(jpg)) - 1}}
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "10s", opts); !errors.As(err, &le) || le.Value != 2400+int64(len(jpg)) {
+		t.Error("expected the memory limit to count the input, got", err)
+	}
+	opts = &Options{Limits: &Limits{MaxMemory: 100}}
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "10s", opts); !errors.As(err, &le) || le.Limit != "memory" || le.Value != 101 {
+		t.Error("expected reading to stop at the memory limit, got", err)
+	}
+
+	// fallbacks are checked up front too
+	opts.Fallbacks = []string{"30s"}
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(jpg), "10s", opts); !errors.Is(err, ErrLimitExceeded) {
+		t.Error("expected the output limit to be hit by the fallback, got", err)
+	}
+}
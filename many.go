@@ -0,0 +1,185 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"context"
+	"image"
+	"runtime"
+	"sync"
+)
+
+// ResizeMany resizes m to each of specs, eg, all the sizes an upload
+// needs, and returns the results keyed by spec. See Resizer.ResizeMany.
+func ResizeMany(m image.Image, specs []string) (map[string]image.Image, error) {
+	return defaultResizer.ResizeMany(m, specs)
+}
+
+// ResizeMany resizes m to each of specs and returns the results keyed
+// by spec. It's a lot less work than calling Resize for each one.
+//
+// Sizes that are much smaller than the source don't start from the
+// source, but from a copy that's been halved (and halved again, and so
+// on) for as long as it stays at least ShrinkMargin (by default 2)
+// times the size of the output. Box filtering from there gives almost
+// exactly the same result, for a fraction of the work. The sizes are
+// resized in parallel, one goroutine per CPU.
+//
+// If any spec is invalid, it returns ErrInvalidSpec and no images.
+func (self *Resizer) ResizeMany(m image.Image, specs []string) (map[string]image.Image, error) {
+	return self.ResizeManyContext(context.Background(), m, specs)
+}
+
+// ResizeManyContext is ResizeMany, stopping early with ctx.Err() if ctx
+// is done before it's finished.
+func (self *Resizer) ResizeManyContext(ctx context.Context, m image.Image, specs []string) (map[string]image.Image, error) {
+	b := m.Bounds()
+	if err := self.opts.Limits.CheckConfig(image.Config{ColorModel: m.ColorModel(), Width: b.Dx(), Height: b.Dy()}); err != nil {
+		return nil, err
+	}
+	margin := self.opts.ShrinkMargin
+	if margin < 1 {
+		margin = 2
+	}
+
+	// work out everything first, so a bad spec fails before any
+	// pixels are touched. each size starts from the source halved
+	// level times.
+	type job struct {
+		spec  string
+		plan  ResizePlan
+		level int
+	}
+	var jobs []job
+	byLevel := make(map[int][]int)
+	deepest := 0
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if seen[spec] {
+			continue
+		}
+		seen[spec] = true
+		plan := self.opts.planImage(MakeSizeSpec(spec), m)
+		if plan.Width < 0 || plan.Height < 0 {
+			return nil, ErrInvalidSpec
+		}
+		if err := self.opts.Limits.CheckPlan(plan); err != nil {
+			return nil, err
+		}
+		level := 0
+		for s := plan.maxShrink(margin); s > 1; s /= 2 {
+			level++
+		}
+		if level > deepest {
+			deepest = level
+		}
+		byLevel[level] = append(byLevel[level], len(jobs))
+		jobs = append(jobs, job{spec, plan, level})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// each size is done by one worker, so they don't need to split
+	// their own work up any further
+	opts := self.opts
+	opts.Workers = 1
+	results := make([]image.Image, len(jobs))
+	var failed error
+	var once sync.Once
+
+	type task struct {
+		i   int
+		src image.Image
+	}
+	tasks := make(chan task)
+	var wg sync.WaitGroup
+	for n := runtime.GOMAXPROCS(0); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				plan := jobs[t.i].plan.shrunk(1<<uint(jobs[t.i].level), t.src.Bounds())
+				out, err := opts.resize(ctx, t.src, plan)
+				if err != nil {
+					// the first error is the interesting one, the
+					// rest are from being cancelled because of it
+					once.Do(func() { failed = err })
+					cancel()
+				}
+				results[t.i] = out
+			}
+		}()
+	}
+
+	// the sizes for each level can start as soon as it's ready, while
+	// the next one is made
+	var err error
+	level := m
+	for k := 0; k <= deepest; k++ {
+		if k > 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			level = halve(level)
+		}
+		for _, i := range byLevel[k] {
+			tasks <- task{i, level}
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	if failed != nil {
+		return nil, failed
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]image.Image, len(jobs))
+	for i, j := range jobs {
+		out[j.spec] = results[i]
+	}
+	return out, nil
+}
+
+// halve returns m at half the size, rounding up, with each pixel the
+// average of the 2x2 block it came from. blocks on the right and bottom
+// edges of an odd sized image are just the pixels that are there.
+func halve(m image.Image) *image.RGBA {
+	r := m.Bounds()
+	rows, scale := rowsFor(m, r)
+	w, h := (r.Dx()+1)/2, (r.Dy()+1)/2
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	top, bottom := make([]uint64, 4*r.Dx()), make([]uint64, 4*r.Dx())
+	for y := 0; y < h; y++ {
+		rows(r.Min.Y+2*y, top)
+		ny := uint64(1)
+		if 2*y+1 < r.Dy() {
+			rows(r.Min.Y+2*y+1, bottom)
+			ny = 2
+		}
+		row := out.Pix[y*out.Stride:]
+		for x := 0; x < w; x++ {
+			nx := uint64(1)
+			if 2*x+1 < r.Dx() {
+				nx = 2
+			}
+			d := nx * ny * scale
+			for c := 0; c < 4; c++ {
+				sum := top[8*x+c]
+				if nx == 2 {
+					sum += top[8*x+4+c]
+				}
+				if ny == 2 {
+					sum += bottom[8*x+c]
+					if nx == 2 {
+						sum += bottom[8*x+4+c]
+					}
+				}
+				row[4*x+c] = uint8((sum + d/2) / d)
+			}
+		}
+	}
+	return out
+}
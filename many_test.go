@@ -0,0 +1,107 @@
+package resize
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_ResizeMany(t *testing.T) {
+	src := smoothImage(1200, 800)
+	specs := []string{"full", "1200w", "600w", "300w", "100s", "crop:100,100,400,400-50s", "37h", "2000w", "100s"}
+	out, err := ResizeMany(src, specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(specs)-1 {
+		t.Error("expected one image per distinct spec, got", len(out))
+	}
+	for _, s := range specs {
+		got, ok := out[s]
+		if !ok {
+			t.Error(s, "-- missing")
+			continue
+		}
+		want := Resize(src, s)
+		if got.Bounds() != want.Bounds() {
+			t.Error(s, "-- got", got.Bounds(), "expected", want.Bounds())
+			continue
+		}
+		// the ones that can't be halved should be exactly the same,
+		// the rest near enough
+		ss := MakeSizeSpec(s)
+		if ss.Plan(src.Bounds()).maxShrink(2) == 1 {
+			if !sameImage(got, want) {
+				t.Error(s, "-- should be identical to Resize")
+			}
+		} else if d := meanDifference(got, want); d > 1 {
+			t.Error(s, "-- too different from Resize", d)
+		}
+	}
+
+	if _, err := ResizeMany(src, []string{"100s", "nonsense"}); err != ErrInvalidSpec {
+		t.Error("expected ErrInvalidSpec, got", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New().ResizeManyContext(ctx, src, specs); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+}
+
+func Test_Halve(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {2, 2}, {5, 3}, {4, 7}} {
+		src := image.NewNRGBA(image.Rect(3, -2, 3+size.X, -2+size.Y))
+		testPattern(src)
+		got := halve(src)
+		if got.Bounds() != image.Rect(0, 0, (size.X+1)/2, (size.Y+1)/2) {
+			t.Error(size, "-- wrong size", got.Bounds())
+			continue
+		}
+		// each pixel is the average of what's in its block
+		for y := 0; y < got.Bounds().Dy(); y++ {
+			for x := 0; x < got.Bounds().Dx(); x++ {
+				var sum [4]uint32
+				n := uint32(0)
+				for dy := 0; dy < 2; dy++ {
+					for dx := 0; dx < 2; dx++ {
+						p := image.Pt(3+2*x+dx, -2+2*y+dy)
+						if !p.In(src.Bounds()) {
+							continue
+						}
+						r, g, b, a := src.At(p.X, p.Y).RGBA()
+						sum[0], sum[1], sum[2], sum[3] = sum[0]+r, sum[1]+g, sum[2]+b, sum[3]+a
+						n++
+					}
+				}
+				want := color.RGBA64{uint16(sum[0] / n), uint16(sum[1] / n), uint16(sum[2] / n), uint16(sum[3] / n)}
+				if !closeColor(got.At(x, y), want) {
+					t.Error(size, x, y, "-- got", got.At(x, y), "expected", want)
+				}
+			}
+		}
+	}
+}
+
+var benchSpecs = []string{"full", "1200w", "600w", "300w", "100s", "50s"}
+
+func BenchmarkResizeMany(b *testing.B) {
+	src := testPatternImage(2400, 1600)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ResizeMany(src, benchSpecs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResizeEach(b *testing.B) {
+	src := testPatternImage(2400, 1600)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range benchSpecs {
+			Resize(src, s)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// MetadataPolicy says which metadata from the source ResizeStream
+// carries over to the output. Metadata is only read from and written
+// to JPEG and PNG files.
+type MetadataPolicy int
+
+const (
+	// MetadataStrip drops everything. This is the default.
+	MetadataStrip MetadataPolicy = iota
+	// MetadataKeepICC keeps just the ICC colour profile.
+	MetadataKeepICC
+	// MetadataKeepCopyright keeps the ICC profile and the EXIF
+	// Artist and Copyright fields.
+	MetadataKeepCopyright
+	// MetadataKeepAll keeps the ICC profile, EXIF and XMP.
+	MetadataKeepAll
+)
+
+// since orientation has already been applied to the pixels by the time
+// anything is written out, any EXIF or XMP we keep always has its
+// orientation reset to OrientationNormal.
+
+const (
+	exifTagArtist    = 0x013b
+	exifTagCopyright = 0x8298
+	exifTypeASCII    = 2
+)
+
+var (
+	iccHeader = []byte("ICC_PROFILE\x00")
+	xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+	xmpOrientationAttr = regexp.MustCompile(`tiff:Orientation="\d"`)
+	xmpOrientationElem = regexp.MustCompile(`<tiff:Orientation>\d</tiff:Orientation>`)
+)
+
+// the most a JPEG segment can hold, after its length
+const maxJPEGSegment = 65535 - 2
+
+// the largest ICC chunk that fits in one APP2 segment
+const maxICCChunk = maxJPEGSegment - 14
+
+// metadata is what we know how to carry from one file to another
+type metadata struct {
+	// icc is the raw ICC profile
+	icc []byte
+	// exif is the TIFF structure from the EXIF segment/chunk
+	exif []byte
+	// xmp is the XMP packet
+	xmp []byte
+	// warnings are about metadata that was left out when reading it
+	warnings []string
+}
+
+// metadataParts says which metadata to read, besides the EXIF, which
+// is always read for the orientation
+type metadataParts struct {
+	icc, xmp bool
+}
+
+var allMetadata = metadataParts{icc: true, xmp: true}
+
+// the most bytes a compressed ICC profile or XMP packet in a PNG is
+// inflated to. real ones are far smaller, anything bigger is a zip bomb
+// or not worth keeping.
+const maxInflatedMetadata = 4 << 20
+
+// readMetadata pulls metadata out of an encoded JPEG or PNG
+func readMetadata(data []byte, format string, parts metadataParts) *metadata {
+	switch format {
+	case "jpeg":
+		return jpegMetadata(data, parts)
+	case "png":
+		return pngMetadata(data, parts)
+	}
+	return &metadata{}
+}
+
+// size is how many bytes the metadata takes that aren't part of the
+// encoded image it was read from
+func (self *metadata) size() int64 {
+	return int64(len(self.icc) + len(self.xmp))
+}
+
+func jpegMetadata(data []byte, parts metadataParts) *metadata {
+	md := &metadata{}
+	type iccChunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []iccChunk
+	for _, s := range jpegSegments(data) {
+		switch {
+		case s.marker == 0xe1 && bytes.HasPrefix(s.payload, exifHeader):
+			md.exif = s.payload[len(exifHeader):]
+		case parts.xmp && s.marker == 0xe1 && bytes.HasPrefix(s.payload, xmpHeader):
+			md.xmp = s.payload[len(xmpHeader):]
+		case parts.icc && s.marker == 0xe2 && bytes.HasPrefix(s.payload, iccHeader) && len(s.payload) >= len(iccHeader)+2:
+			chunks = append(chunks, iccChunk{seq: s.payload[len(iccHeader)], data: s.payload[len(iccHeader)+2:]})
+		}
+	}
+	// profiles bigger than a segment are split into numbered chunks
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+	for _, c := range chunks {
+		md.icc = append(md.icc, c.data...)
+	}
+	return md
+}
+
+// pngChunk is a chunk from a PNG file
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngChunks returns the chunks of a PNG, stopping at anything malformed
+func pngChunks(data []byte) []pngChunk {
+	if !bytes.HasPrefix(data, pngHeader) {
+		return nil
+	}
+	var chunks []pngChunk
+	i := len(pngHeader)
+	for i+12 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if n < 0 || i+12+n > len(data) {
+			break
+		}
+		typ := string(data[i+4 : i+8])
+		chunks = append(chunks, pngChunk{typ: typ, data: data[i+8 : i+8+n]})
+		if typ == "IEND" {
+			break
+		}
+		i += 12 + n
+	}
+	return chunks
+}
+
+func pngMetadata(data []byte, parts metadataParts) *metadata {
+	md := &metadata{}
+	for _, c := range pngChunks(data) {
+		switch {
+		case c.typ == "iCCP" && parts.icc:
+			// name, NUL, compression method (always 0, zlib), profile
+			if i := bytes.IndexByte(c.data, 0); i >= 0 && i+2 <= len(c.data) {
+				var ok bool
+				if md.icc, ok = inflate(c.data[i+2:]); !ok {
+					md.warnings = append(md.warnings, "ICC profile dropped: too big uncompressed")
+				}
+			}
+		case c.typ == "eXIf":
+			md.exif = c.data
+		case c.typ == "iTXt" && parts.xmp:
+			xmp, ok := pngXMP(c.data)
+			if !ok {
+				md.warnings = append(md.warnings, "XMP dropped: too big uncompressed")
+			} else if xmp != nil {
+				md.xmp = xmp
+			}
+		}
+	}
+	return md
+}
+
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// pngXMP returns the text of an iTXt chunk if it's XMP. it's only
+// false if the XMP inflates to more than maxInflatedMetadata.
+func pngXMP(data []byte) ([]byte, bool) {
+	// keyword, NUL, compression flag, compression method,
+	// language tag, NUL, translated keyword, NUL, text
+	if !bytes.HasPrefix(data, []byte(pngXMPKeyword+"\x00")) {
+		return nil, true
+	}
+	rest := data[len(pngXMPKeyword)+1:]
+	if len(rest) < 2 {
+		return nil, true
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+	for k := 0; k < 2; k++ {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			return nil, true
+		}
+		rest = rest[i+1:]
+	}
+	if compressed {
+		return inflate(rest)
+	}
+	return rest, true
+}
+
+// inflate decompresses zlib data, returning nil if it's corrupt, and
+// nil and false if there's more than maxInflatedMetadata of it
+func inflate(data []byte) ([]byte, bool) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, true
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxInflatedMetadata+1))
+	if err != nil {
+		return nil, true
+	}
+	if len(out) > maxInflatedMetadata {
+		return nil, false
+	}
+	return out, true
+}
+
+// filter returns the metadata that the policy allows through,
+// with orientation reset
+func (self *metadata) filter(policy MetadataPolicy) *metadata {
+	out := &metadata{}
+	if self == nil {
+		return out
+	}
+	switch policy {
+	case MetadataKeepICC:
+		out.icc = self.icc
+	case MetadataKeepCopyright:
+		out.icc = self.icc
+		out.exif = copyrightExif(self.exif)
+	case MetadataKeepAll:
+		out.icc = self.icc
+		out.exif = resetExifOrientation(self.exif)
+		out.xmp = resetXMPOrientation(self.xmp)
+	}
+	return out
+}
+
+func (self *metadata) isEmpty() bool {
+	return len(self.icc) == 0 && len(self.exif) == 0 && len(self.xmp) == 0
+}
+
+// jpegWarnings returns a warning for each kind of metadata that's too
+// big to fit in a JPEG, which embedJPEG leaves out
+func (self *metadata) jpegWarnings() []string {
+	var warnings []string
+	if self.exif != nil && len(exifHeader)+len(self.exif) > maxJPEGSegment {
+		warnings = append(warnings, fmt.Sprintf("EXIF dropped: %d bytes is too big for a JPEG segment", len(self.exif)))
+	}
+	if self.xmp != nil && len(xmpHeader)+len(self.xmp) > maxJPEGSegment {
+		warnings = append(warnings, fmt.Sprintf("XMP dropped: %d bytes is too big for a JPEG segment", len(self.xmp)))
+	}
+	if (len(self.icc)+maxICCChunk-1)/maxICCChunk > 255 {
+		warnings = append(warnings, fmt.Sprintf("ICC profile dropped: %d bytes is too big for a JPEG", len(self.icc)))
+	}
+	return warnings
+}
+
+// resetExifOrientation returns a copy of the EXIF data with its
+// orientation tag (if it has one) set to OrientationNormal
+func resetExifOrientation(tiff []byte) []byte {
+	if tiff == nil {
+		return nil
+	}
+	out := append([]byte{}, tiff...)
+	order, entries, ok := exifIFD0(out)
+	if !ok {
+		return out
+	}
+	for _, e := range entries {
+		if e.tag == exifTagOrientation && e.typ == exifTypeShort && e.count == 1 {
+			order.PutUint16(out[e.offset+8:], uint16(OrientationNormal))
+		}
+	}
+	return out
+}
+
+func resetXMPOrientation(xmp []byte) []byte {
+	if xmp == nil {
+		return nil
+	}
+	xmp = xmpOrientationAttr.ReplaceAll(xmp, []byte(`tiff:Orientation="1"`))
+	return xmpOrientationElem.ReplaceAll(xmp, []byte(`<tiff:Orientation>1</tiff:Orientation>`))
+}
+
+// exifString returns the value of an ASCII tag in IFD0
+func exifString(tiff []byte, tag uint16) (string, bool) {
+	order, entries, ok := exifIFD0(tiff)
+	if !ok {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.tag != tag || e.typ != exifTypeASCII || e.count == 0 {
+			continue
+		}
+		n := int(e.count)
+		start := e.offset + 8
+		if n > 4 {
+			start = int(order.Uint32(tiff[e.offset+8:]))
+		}
+		if start < 0 || start+n > len(tiff) {
+			return "", false
+		}
+		return string(bytes.TrimRight(tiff[start:start+n], "\x00")), true
+	}
+	return "", false
+}
+
+// copyrightExif builds a new, minimal, EXIF structure with just the
+// Artist and Copyright fields from tiff, and a normal orientation.
+// it returns nil if there's no Artist or Copyright.
+func copyrightExif(tiff []byte) []byte {
+	artist, hasArtist := exifString(tiff, exifTagArtist)
+	copyright, hasCopyright := exifString(tiff, exifTagCopyright)
+	if !hasArtist && !hasCopyright {
+		return nil
+	}
+	var entries []exifEntry
+	entries = append(entries, exifEntry{tag: exifTagOrientation, typ: exifTypeShort, short: uint16(OrientationNormal)})
+	if hasArtist {
+		entries = append(entries, exifEntry{tag: exifTagArtist, typ: exifTypeASCII, ascii: artist})
+	}
+	if hasCopyright {
+		entries = append(entries, exifEntry{tag: exifTagCopyright, typ: exifTypeASCII, ascii: copyright})
+	}
+	return buildExif(entries)
+}
+
+// exifEntry is a tag to write with buildExif. only SHORT and ASCII
+// values are supported, which is all we need.
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	short uint16
+	ascii string
+}
+
+// buildExif writes a big-endian TIFF structure with a single IFD.
+// entries must be sorted by tag.
+func buildExif(entries []exifEntry) []byte {
+	order := binary.BigEndian
+	ifdSize := 2 + 12*len(entries) + 4
+	var head, values bytes.Buffer
+	head.WriteString("MM")
+	binary.Write(&head, order, uint16(42))
+	binary.Write(&head, order, uint32(8))
+	binary.Write(&head, order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&head, order, e.tag)
+		binary.Write(&head, order, e.typ)
+		switch e.typ {
+		case exifTypeShort:
+			binary.Write(&head, order, uint32(1))
+			binary.Write(&head, order, e.short)
+			binary.Write(&head, order, uint16(0))
+		case exifTypeASCII:
+			s := append([]byte(e.ascii), 0)
+			binary.Write(&head, order, uint32(len(s)))
+			if len(s) <= 4 {
+				head.Write(append(s, make([]byte, 4-len(s))...))
+			} else {
+				binary.Write(&head, order, uint32(8+ifdSize+values.Len()))
+				values.Write(s)
+				if values.Len()%2 == 1 {
+					// keep offsets word aligned
+					values.WriteByte(0)
+				}
+			}
+		}
+	}
+	// no next IFD
+	binary.Write(&head, order, uint32(0))
+	head.Write(values.Bytes())
+	return head.Bytes()
+}
+
+// embedMetadata inserts metadata into an encoded image. formats we
+// don't know how to add metadata to are returned unchanged.
+func embedMetadata(data []byte, format string, md *metadata) []byte {
+	if md == nil || md.isEmpty() {
+		return data
+	}
+	switch format {
+	case "jpeg":
+		return embedJPEG(data, md)
+	case "png":
+		return embedPNG(data, md)
+	}
+	return data
+}
+
+func embedJPEG(data []byte, md *metadata) []byte {
+	if len(data) < 2 {
+		return data
+	}
+	var buf bytes.Buffer
+	// SOI
+	buf.Write(data[:2])
+	if md.exif != nil {
+		writeJPEGSegment(&buf, 0xe1, exifHeader, md.exif)
+	}
+	if md.xmp != nil {
+		writeJPEGSegment(&buf, 0xe1, xmpHeader, md.xmp)
+	}
+	if md.icc != nil {
+		n := (len(md.icc) + maxICCChunk - 1) / maxICCChunk
+		if n <= 255 {
+			for i := 0; i < n; i++ {
+				end := (i + 1) * maxICCChunk
+				if end > len(md.icc) {
+					end = len(md.icc)
+				}
+				header := append(append([]byte{}, iccHeader...), byte(i+1), byte(n))
+				writeJPEGSegment(&buf, 0xe2, header, md.icc[i*maxICCChunk:end])
+			}
+		}
+	}
+	buf.Write(data[2:])
+	return buf.Bytes()
+}
+
+func writeJPEGSegment(buf *bytes.Buffer, marker byte, header, payload []byte) {
+	// too big to fit, see jpegWarnings
+	if len(header)+len(payload) > maxJPEGSegment {
+		return
+	}
+	n := 2 + len(header) + len(payload)
+	buf.Write([]byte{0xff, marker, byte(n >> 8), byte(n)})
+	buf.Write(header)
+	buf.Write(payload)
+}
+
+func embedPNG(data []byte, md *metadata) []byte {
+	chunks := pngChunks(data)
+	if len(chunks) == 0 || chunks[0].typ != "IHDR" {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.Write(pngHeader)
+	writePNGChunk(&buf, "IHDR", chunks[0].data)
+	if md.icc != nil {
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(md.icc)
+		w.Close()
+		writePNGChunk(&buf, "iCCP", append([]byte("ICC Profile\x00\x00"), z.Bytes()...))
+	}
+	if md.exif != nil {
+		writePNGChunk(&buf, "eXIf", md.exif)
+	}
+	if md.xmp != nil {
+		// uncompressed, no language or translated keyword
+		writePNGChunk(&buf, "iTXt", append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), md.xmp...))
+	}
+	for _, c := range chunks[1:] {
+		writePNGChunk(&buf, c.typ, c.data)
+	}
+	return buf.Bytes()
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
@@ -0,0 +1,197 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/png"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testMetadataJPEG builds a 40x20 JPEG with an ICC profile big enough
+// to need more than one segment, EXIF with an orientation and
+// copyright, and XMP
+func testMetadataJPEG(t *testing.T) ([]byte, *metadata) {
+	md := &metadata{
+		icc: bytes.Repeat([]byte("0123456789abcdef"), 5000),
+		exif: buildExif([]exifEntry{
+			{tag: exifTagOrientation, typ: exifTypeShort, short: uint16(OrientationRotate90)},
+			{tag: exifTagArtist, typ: exifTypeASCII, ascii: "Ann"},
+			{tag: exifTagCopyright, typ: exifTypeASCII, ascii: "(c) 2026 Ann Example"},
+		}),
+		xmp: []byte(`<x:xmpmeta><rdf:Description tiff:Orientation="6" dc:rights="mine"/></x:xmpmeta>`),
+	}
+	return embedMetadata(testJPEG(t, 40, 20), "jpeg", md), md
+}
+
+func Test_ReadMetadata(t *testing.T) {
+	jpg, md := testMetadataJPEG(t)
+	got := readMetadata(jpg, "jpeg", allMetadata)
+	if !bytes.Equal(got.icc, md.icc) {
+		t.Error("ICC profile doesn't round trip through JPEG", len(got.icc), len(md.icc))
+	}
+	if !bytes.Equal(got.exif, md.exif) || !bytes.Equal(got.xmp, md.xmp) {
+		t.Error("EXIF/XMP don't round trip through JPEG")
+	}
+	if s, ok := exifString(got.exif, exifTagCopyright); !ok || s != "(c) 2026 Ann Example" {
+		t.Error("bad copyright", s)
+	}
+	if s, ok := exifString(got.exif, exifTagArtist); !ok || s != "Ann" {
+		t.Error("bad artist", s)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testPatternImage(10, 10)); err != nil {
+		t.Fatal(err)
+	}
+	withMeta := embedMetadata(buf.Bytes(), "png", md)
+	if _, err := png.Decode(bytes.NewReader(withMeta)); err != nil {
+		t.Fatal("PNG with metadata doesn't decode", err)
+	}
+	got = readMetadata(withMeta, "png", allMetadata)
+	if !bytes.Equal(got.icc, md.icc) || !bytes.Equal(got.exif, md.exif) || !bytes.Equal(got.xmp, md.xmp) {
+		t.Error("metadata doesn't round trip through PNG")
+	}
+}
+
+func Test_MetadataPolicy(t *testing.T) {
+	jpg, md := testMetadataJPEG(t)
+	for _, format := range []string{"jpeg", "png"} {
+		for _, policy := range []MetadataPolicy{MetadataStrip, MetadataKeepICC, MetadataKeepCopyright, MetadataKeepAll} {
+			var out bytes.Buffer
+			res, err := ResizeStream(&out, bytes.NewReader(jpg), "10w", &Options{Format: format, Metadata: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Width != 10 || res.Height != 20 {
+				t.Error(format, policy, "-- orientation wasn't applied", res.Width, res.Height)
+			}
+			got := readMetadata(out.Bytes(), format, allMetadata)
+			if (policy != MetadataStrip) != bytes.Equal(got.icc, md.icc) {
+				t.Error(format, policy, "-- wrong ICC profile", len(got.icc))
+			}
+			switch policy {
+			case MetadataStrip, MetadataKeepICC:
+				if got.exif != nil || got.xmp != nil {
+					t.Error(format, policy, "-- EXIF/XMP should be stripped")
+				}
+			case MetadataKeepCopyright:
+				if got.xmp != nil {
+					t.Error(format, policy, "-- XMP should be stripped")
+				}
+				if s, _ := exifString(got.exif, exifTagCopyright); s != "(c) 2026 Ann Example" {
+					t.Error(format, policy, "-- bad copyright", s)
+				}
+				if s, _ := exifString(got.exif, exifTagArtist); s != "Ann" {
+					t.Error(format, policy, "-- bad artist", s)
+				}
+			case MetadataKeepAll:
+				if !bytes.Contains(got.xmp, []byte(`tiff:Orientation="1"`)) || !bytes.Contains(got.xmp, []byte("dc:rights")) {
+					t.Error(format, policy, "-- bad XMP", string(got.xmp))
+				}
+				if s, _ := exifString(got.exif, exifTagCopyright); s != "(c) 2026 Ann Example" {
+					t.Error(format, policy, "-- bad copyright", s)
+				}
+			}
+			if got.exif != nil && exifOrientation(got.exif) != OrientationNormal {
+				t.Error(format, policy, "-- orientation wasn't reset")
+			}
+		}
+	}
+}
+
+func Test_ResetExifOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		seg := exifSegment(order, OrientationRotate270)
+		tiff := seg[4+len(exifHeader):]
+		reset := resetExifOrientation(tiff)
+		if exifOrientation(reset) != OrientationNormal {
+			t.Error(order, "-- orientation wasn't reset")
+		}
+		if exifOrientation(tiff) != OrientationRotate270 {
+			t.Error(order, "-- original was modified")
+		}
+	}
+}
+
+func Test_MetadataTooBigForJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testPatternImage(10, 10)); err != nil {
+		t.Fatal(err)
+	}
+	// fine in a PNG, but more than a JPEG segment can hold
+	xmp := append([]byte("<x:xmpmeta>"), bytes.Repeat([]byte(" "), 70000)...)
+	src := embedMetadata(buf.Bytes(), "png", &metadata{xmp: append(xmp, "</x:xmpmeta>"...)})
+
+	var out bytes.Buffer
+	res, err := ResizeStream(&out, bytes.NewReader(src), "full", &Options{Format: "jpeg", Metadata: MetadataKeepAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 1 || !strings.HasPrefix(res.Warnings[0], "XMP dropped") {
+		t.Error("expected a warning about the XMP, got", res.Warnings)
+	}
+	if readMetadata(out.Bytes(), "jpeg", allMetadata).xmp != nil {
+		t.Error("XMP should have been dropped")
+	}
+
+	out.Reset()
+	res, err = ResizeStream(&out, bytes.NewReader(src), "full", &Options{Format: "png", Metadata: MetadataKeepAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 0 || readMetadata(out.Bytes(), "png", allMetadata).xmp == nil {
+		t.Error("XMP should fit in a PNG", res.Warnings)
+	}
+}
+
+// iccBombPNG is a small PNG with an ICC profile of n zeros, which
+// compresses to next to nothing
+func iccBombPNG(t *testing.T, n int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testPatternImage(8, 8)); err != nil {
+		t.Fatal(err)
+	}
+	return embedMetadata(buf.Bytes(), "png", &metadata{icc: make([]byte, n)})
+}
+
+func Test_MetadataInflateLimits(t *testing.T) {
+	bomb := iccBombPNG(t, 64<<20)
+	limits := &Limits{MaxSourcePixels: 1000, MaxMemory: 1 << 20}
+
+	// the profile isn't needed, so it isn't inflated at all
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	res, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(bomb), "4s", &Options{Limits: limits})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 0 {
+		t.Error("unexpected warnings", res.Warnings)
+	}
+	if used := after.TotalAlloc - before.TotalAlloc; used > 8<<20 {
+		t.Error("unneeded profile was inflated,", used, "bytes allocated")
+	}
+
+	// when it is needed, it's dropped once it gets too big
+	res, err = ResizeStream(&bytes.Buffer{}, bytes.NewReader(bomb), "4s", &Options{ColorManage: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 1 || !strings.HasPrefix(res.Warnings[0], "ICC profile dropped") {
+		t.Error("expected a warning about the profile, got", res.Warnings)
+	}
+
+	// and what is inflated counts against the memory limit
+	big := iccBombPNG(t, 2<<20)
+	_, err = ResizeStream(&bytes.Buffer{}, bytes.NewReader(big), "4s", &Options{Limits: limits, Metadata: MetadataKeepICC})
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Error("expected the memory limit to be hit, got", err)
+	}
+	if _, err := ResizeStream(&bytes.Buffer{}, bytes.NewReader(big), "4s", &Options{Limits: limits}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,325 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Orientation is one of the eight ways an image can be flipped and/or
+// rotated. The values match the EXIF Orientation tag, and each one names
+// the transform that needs to be applied to the stored pixels to get
+// the image the right way up.
+type Orientation int
+
+const (
+	OrientationNormal     Orientation = 1 + iota // as stored
+	OrientationFlipH                             // mirror left to right
+	OrientationRotate180                         // upside down
+	OrientationFlipV                             // mirror top to bottom
+	OrientationTranspose                         // flip along the top-left to bottom-right diagonal
+	OrientationRotate90                          // rotate 90 degrees clockwise
+	OrientationTransverse                        // flip along the top-right to bottom-left diagonal
+	OrientationRotate270                         // rotate 270 degrees clockwise
+)
+
+// IsValid is true for the eight defined orientations
+func (self Orientation) IsValid() bool {
+	return self >= OrientationNormal && self <= OrientationRotate270
+}
+
+// SwapsAxes is true if the transform turns width into height
+func (self Orientation) SwapsAxes() bool {
+	return self >= OrientationTranspose && self <= OrientationRotate270
+}
+
+// Bounds returns the bounds of an image with bounds r once it's been
+// transformed. Like the result of Orient, it always starts at 0,0.
+func (self Orientation) Bounds(r image.Rectangle) image.Rectangle {
+	if self.SwapsAxes() {
+		return image.Rect(0, 0, r.Dy(), r.Dx())
+	}
+	return image.Rect(0, 0, r.Dx(), r.Dy())
+}
+
+// source returns the position in the source image (relative to its top
+// left corner) of the pixel that ends up at x,y in the transformed image.
+// w and h are the source's dimensions.
+func (self Orientation) source(x, y, w, h int) (int, int) {
+	switch self {
+	case OrientationFlipH:
+		return w - 1 - x, y
+	case OrientationRotate180:
+		return w - 1 - x, h - 1 - y
+	case OrientationFlipV:
+		return x, h - 1 - y
+	case OrientationTranspose:
+		return y, x
+	case OrientationRotate90:
+		return y, h - 1 - x
+	case OrientationTransverse:
+		return w - 1 - y, h - 1 - x
+	case OrientationRotate270:
+		return w - 1 - y, x
+	}
+	return x, y
+}
+
+// transforms is true for the orientations that change the image, that
+// is, the valid ones other than OrientationNormal
+func (self Orientation) transforms() bool {
+	return self.IsValid() && self != OrientationNormal
+}
+
+// the spec components for orientations. see MakeSizeSpec
+var orientationTokens = map[string]Orientation{
+	"r90":  OrientationRotate90,
+	"r180": OrientationRotate180,
+	"r270": OrientationRotate270,
+	"fh":   OrientationFlipH,
+	"fv":   OrientationFlipV,
+}
+
+// specString returns the orientation as spec components, or "" for
+// none. the two diagonal flips don't have their own, so they're a
+// rotation followed by a flip.
+func (self Orientation) specString() string {
+	switch self {
+	case OrientationFlipH:
+		return "fh"
+	case OrientationRotate180:
+		return "r180"
+	case OrientationFlipV:
+		return "fv"
+	case OrientationTranspose:
+		return "r90-fh"
+	case OrientationRotate90:
+		return "r90"
+	case OrientationTransverse:
+		return "r90-fv"
+	case OrientationRotate270:
+		return "r270"
+	}
+	return ""
+}
+
+// then returns the orientation that's the same as transforming by self
+// and then by next
+func (self Orientation) then(next Orientation) Orientation {
+	if !next.transforms() {
+		return self
+	}
+	if !self.transforms() {
+		return next
+	}
+	// find the one that puts every pixel of a small image (with sides
+	// of different lengths, so nothing is ambiguous) in the same place
+	src := image.Rect(0, 0, 2, 3)
+	mid := self.Bounds(src)
+	out := next.Bounds(mid)
+	for o := OrientationNormal; o <= OrientationRotate270; o++ {
+		if o.Bounds(src) == out && o.matches(out, func(x, y int) (int, int) {
+			x, y = next.source(x, y, mid.Dx(), mid.Dy())
+			return self.source(x, y, src.Dx(), src.Dy())
+		}) {
+			return o
+		}
+	}
+	return OrientationNormal
+}
+
+// matches is true if source gives the same positions as the
+// orientation's for every pixel of out
+func (self Orientation) matches(out image.Rectangle, source func(x, y int) (int, int)) bool {
+	w, h := out.Dy(), out.Dx()
+	if !self.SwapsAxes() {
+		w, h = out.Dx(), out.Dy()
+	}
+	for y := 0; y < out.Dy(); y++ {
+		for x := 0; x < out.Dx(); x++ {
+			sx, sy := source(x, y)
+			if ox, oy := self.source(x, y, w, h); ox != sx || oy != sy {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// orientedBounds returns the bounds of an image with bounds src once
+// it's been transformed, keeping the same top left corner
+func (self Orientation) orientedBounds(src image.Rectangle) image.Rectangle {
+	if !self.transforms() {
+		return src
+	}
+	return self.Bounds(src).Add(src.Min)
+}
+
+// sourceRect maps r, which is in the transformed coordinates of
+// orientedBounds(src), back to the part of src it came from
+func (self Orientation) sourceRect(r, src image.Rectangle) image.Rectangle {
+	if !self.transforms() || r.Empty() {
+		return r
+	}
+	w, h := src.Dx(), src.Dy()
+	r = r.Sub(src.Min)
+	x0, y0 := self.source(r.Min.X, r.Min.Y, w, h)
+	x1, y1 := self.source(r.Max.X-1, r.Max.Y-1, w, h)
+	out := image.Rect(x0, y0, x1, y1)
+	out.Max = out.Max.Add(image.Pt(1, 1))
+	return out.Add(src.Min)
+}
+
+// Orient returns m transformed by o. For OrientationNormal (or an
+// invalid orientation) it returns m itself. *image.RGBA, *image.NRGBA,
+// *image.Gray and *image.YCbCr images have their pixels moved directly
+// and come back as the same type, anything else comes back as an
+// *image.RGBA.
+func Orient(m image.Image, o Orientation) image.Image {
+	if !o.transforms() {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	ob := o.Bounds(b)
+	if b.Empty() {
+		return image.NewRGBA(ob)
+	}
+	switch m := m.(type) {
+	case *image.RGBA:
+		out := image.NewRGBA(ob)
+		orientPlane(out.Pix, out.Stride, m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, w, h, 4, o)
+		return out
+	case *image.NRGBA:
+		out := image.NewNRGBA(ob)
+		orientPlane(out.Pix, out.Stride, m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, w, h, 4, o)
+		return out
+	case *image.Gray:
+		out := image.NewGray(ob)
+		orientPlane(out.Pix, out.Stride, m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, w, h, 1, o)
+		return out
+	case *image.YCbCr:
+		return orientYCbCr(m, o)
+	}
+	out := image.NewRGBA(ob)
+	for y := 0; y < ob.Dy(); y++ {
+		for x := 0; x < ob.Dx(); x++ {
+			sx, sy := o.source(x, y, w, h)
+			out.SetRGBA(x, y, color.RGBAModel.Convert(m.At(b.Min.X+sx, b.Min.Y+sy)).(color.RGBA))
+		}
+	}
+	return out
+}
+
+// orientPlane copies a w x h plane of size byte pixels from src to
+// dst, transformed by o. src and dst start at their top left pixels.
+func orientPlane(dst []uint8, dstStride int, src []uint8, srcStride, w, h, size int, o Orientation) {
+	ow, oh := w, h
+	if o.SwapsAxes() {
+		ow, oh = h, w
+	}
+	for y := 0; y < oh; y++ {
+		// the source of each row of the output is a straight line,
+		// along a row or column of the source
+		x0, y0 := o.source(0, y, w, h)
+		x1, y1 := o.source(1, y, w, h)
+		i := y0*srcStride + x0*size
+		step := (y1-y0)*srcStride + (x1-x0)*size
+		row := dst[y*dstStride : y*dstStride+ow*size]
+		switch size {
+		case 1:
+			for x := range row {
+				row[x] = src[i]
+				i += step
+			}
+		case 4:
+			for x := 0; x < len(row); x += 4 {
+				row[x], row[x+1], row[x+2], row[x+3] = src[i], src[i+1], src[i+2], src[i+3]
+				i += step
+			}
+		default:
+			for x := 0; x < len(row); x += size {
+				copy(row[x:x+size], src[i:i+size])
+				i += step
+			}
+		}
+	}
+}
+
+// subsampling returns how many pixels across and down share each
+// chroma sample
+func subsampling(ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2
+	}
+	return 1, 1
+}
+
+// orientYCbCr transforms a YCbCr image without converting it. the
+// chroma planes are moved like the luma one when the image is made of
+// whole chroma blocks and there's a subsampling ratio for the
+// transformed blocks. otherwise the result has a chroma sample for
+// every pixel.
+func orientYCbCr(m *image.YCbCr, o Orientation) *image.YCbCr {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	fx, fy := subsampling(m.SubsampleRatio)
+	ratio := m.SubsampleRatio
+	whole := b.Min.X%fx == 0 && b.Min.Y%fy == 0 && w%fx == 0 && h%fy == 0
+	if o.SwapsAxes() {
+		switch ratio {
+		case image.YCbCrSubsampleRatio422:
+			ratio = image.YCbCrSubsampleRatio440
+		case image.YCbCrSubsampleRatio440:
+			ratio = image.YCbCrSubsampleRatio422
+		case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+			// there's no 1:4 ratio
+			whole = false
+		}
+	}
+	if !whole {
+		ratio = image.YCbCrSubsampleRatio444
+	}
+	out := image.NewYCbCr(o.Bounds(b), ratio)
+	orientPlane(out.Y, out.YStride, m.Y[m.YOffset(b.Min.X, b.Min.Y):], m.YStride, w, h, 1, o)
+	if whole {
+		ci := m.COffset(b.Min.X, b.Min.Y)
+		orientPlane(out.Cb, out.CStride, m.Cb[ci:], m.CStride, w/fx, h/fy, 1, o)
+		orientPlane(out.Cr, out.CStride, m.Cr[ci:], m.CStride, w/fx, h/fy, 1, o)
+		return out
+	}
+	ob := out.Bounds()
+	for y := 0; y < ob.Dy(); y++ {
+		for x := 0; x < ob.Dx(); x++ {
+			sx, sy := o.source(x, y, w, h)
+			ci := m.COffset(b.Min.X+sx, b.Min.Y+sy)
+			out.Cb[y*out.CStride+x] = m.Cb[ci]
+			out.Cr[y*out.CStride+x] = m.Cr[ci]
+		}
+	}
+	return out
+}
+
+// orientInto draws m transformed by o into dst, which has to be the
+// transformed size
+func orientInto(dst draw.Image, m *image.RGBA, o Orientation) {
+	b := m.Bounds()
+	if d, ok := dst.(*image.RGBA); ok && !b.Empty() {
+		orientPlane(d.Pix[d.PixOffset(d.Rect.Min.X, d.Rect.Min.Y):], d.Stride,
+			m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, b.Dx(), b.Dy(), 4, o)
+		return
+	}
+	draw.Draw(dst, dst.Bounds(), Orient(m, o), image.Point{}, draw.Src)
+}
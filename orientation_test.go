@@ -0,0 +1,193 @@
+package resize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+func Test_Orient(t *testing.T) {
+	// a 3x2 image with every pixel different:
+	//   a b c
+	//   d e f
+	m := image.NewGray(image.Rect(10, 10, 13, 12))
+	for i, v := range []uint8{'a', 'b', 'c', 'd', 'e', 'f'} {
+		m.SetGray(10+i%3, 10+i/3, color.Gray{v})
+	}
+	cases := []struct {
+		o    Orientation
+		rows []string
+	}{
+		{OrientationNormal, []string{"abc", "def"}},
+		{OrientationFlipH, []string{"cba", "fed"}},
+		{OrientationRotate180, []string{"fed", "cba"}},
+		{OrientationFlipV, []string{"def", "abc"}},
+		{OrientationTranspose, []string{"ad", "be", "cf"}},
+		{OrientationRotate90, []string{"da", "eb", "fc"}},
+		{OrientationTransverse, []string{"fc", "eb", "da"}},
+		{OrientationRotate270, []string{"cf", "be", "ad"}},
+	}
+	for _, c := range cases {
+		out := Orient(m, c.o)
+		b := out.Bounds()
+		if b.Dy() != len(c.rows) || b.Dx() != len(c.rows[0]) {
+			t.Error(c.o, "-- bad bounds", b)
+			continue
+		}
+		if b != c.o.Bounds(m.Bounds()) && c.o != OrientationNormal {
+			t.Error(c.o, "-- bounds don't match Orientation.Bounds", b)
+		}
+		for y, row := range c.rows {
+			for x := range row {
+				g := color.GrayModel.Convert(out.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+				if g.Y != row[x] {
+					t.Errorf("%d -- pixel %d,%d is %c, expected %c", c.o, x, y, g.Y, row[x])
+				}
+			}
+		}
+	}
+}
+
+// orientPattern returns a w x h image, not at 0,0, with every pixel
+// different
+func orientPattern(w, h int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(3, 5, 3+w, 5+h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(3+x, 5+y, color.NRGBA{uint8(x * 13), uint8(y * 7), uint8(x*y + 50), uint8(128 + x + y)})
+		}
+	}
+	return m
+}
+
+func Test_OrientFastPaths(t *testing.T) {
+	pattern := orientPattern(12, 8)
+	b := pattern.Bounds()
+	rgba := image.NewRGBA(b)
+	gray := image.NewGray(b)
+	draw.Draw(rgba, b, pattern, b.Min, draw.Src)
+	draw.Draw(gray, b, pattern, b.Min, draw.Src)
+	images := map[string]image.Image{"rgba": rgba, "nrgba": pattern, "gray": gray}
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410,
+	}
+	for _, ratio := range ratios {
+		// whole chroma blocks, and not
+		for _, r := range []image.Rectangle{image.Rect(0, 0, 8, 4), image.Rect(1, 1, 8, 6)} {
+			m := image.NewYCbCr(r, ratio)
+			for i := range m.Y {
+				m.Y[i] = uint8(i * 3)
+			}
+			for i := range m.Cb {
+				m.Cb[i], m.Cr[i] = uint8(i*5), uint8(255-i*5)
+			}
+			images[fmt.Sprint("ycbcr ", ratio, " ", r)] = m
+		}
+	}
+	for name, m := range images {
+		mb := m.Bounds()
+		for o := OrientationFlipH; o <= OrientationRotate270; o++ {
+			out := Orient(m, o)
+			if reflect.TypeOf(out) != reflect.TypeOf(m) {
+				t.Errorf("%s %d -- got a %T", name, o, out)
+			}
+			ob := out.Bounds()
+			if ob != o.Bounds(mb) {
+				t.Errorf("%s %d -- bad bounds %v", name, o, ob)
+				continue
+			}
+			for y := 0; y < ob.Dy(); y++ {
+				for x := 0; x < ob.Dx(); x++ {
+					sx, sy := o.source(x, y, mb.Dx(), mb.Dy())
+					want := color.RGBA64Model.Convert(m.At(mb.Min.X+sx, mb.Min.Y+sy))
+					if got := color.RGBA64Model.Convert(out.At(x, y)); got != want {
+						t.Fatalf("%s %d -- pixel %d,%d is %v, expected %v", name, o, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_OrientationThen(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	for a := OrientationNormal; a <= OrientationRotate270; a++ {
+		for b := OrientationNormal; b <= OrientationRotate270; b++ {
+			want := Orient(Orient(m, a), b).(*image.Gray)
+			got := Orient(m, a.then(b)).(*image.Gray)
+			if !bytes.Equal(got.Pix, want.Pix) || got.Bounds() != want.Bounds() {
+				t.Errorf("%d then %d -- got %d", a, b, a.then(b))
+			}
+		}
+		if a != OrientationNormal {
+			if got := MakeSizeSpec(a.specString() + "-100s").orient; got != a {
+				t.Errorf("%d -- %q parses as %d", a, a.specString(), got)
+			}
+		}
+	}
+}
+
+type orientSpecTestCase struct {
+	Spec      string
+	Canonical string
+	W, H      int
+}
+
+func Test_SpecOrientation(t *testing.T) {
+	m := orientPattern(40, 20)
+	cases := []orientSpecTestCase{
+		{"r90-10w", "r90-10w", 10, 20},
+		{"10w-r90", "r90-10w", 10, 20},
+		{"r270/10w", "r270-10w", 10, 20},
+		{"r180-10w", "r180-10w", 10, 5},
+		{"fh-10w", "fh-10w", 10, 5},
+		{"fv-10s", "fv-10s", 10, 10},
+		{"fh-fh-10w", "10w", 10, 5},
+		{"r90-r90", "r180-full", 40, 20},
+		{"r90-fh-10w5h", "r90-fh-10w5h", 10, 5},
+		{"r270-fv-10h", "r90-fh-10h", 5, 10},
+		{"r90", "r90-full", 20, 40},
+		{"r90-30w30h", "r90-30w30h", 15, 30},
+		{"crop:0,0,10,30-r90-5w", "r90-crop:0,0,10,30-5w", 5, 15},
+		{"r90-crop:0.5,0,0.5,1-10s-sharp", "r90-crop:0.5,0,0.5,1-10s-sharp", 10, 10},
+	}
+	for _, c := range cases {
+		ss := MakeSizeSpec(c.Spec)
+		if got := ss.Canonical(); got != c.Canonical {
+			t.Errorf("%s -- canonical %q, expected %q", c.Spec, got, c.Canonical)
+		}
+		plan := ss.Plan(m.Bounds())
+		if plan.Width != c.W || plan.Height != c.H {
+			t.Errorf("%s -- plan is %dx%d, expected %dx%d", c.Spec, plan.Width, plan.Height, c.W, c.H)
+		}
+		if !plan.Crop.In(m.Bounds()) {
+			t.Errorf("%s -- crop %v isn't in the source", c.Spec, plan.Crop)
+		}
+
+		// it's the same as turning the image first
+		turned := Orient(m, ss.orient)
+		unturned := *ss
+		unturned.orient = 0
+		want := Resize(turned, unturned.String()).(*image.RGBA)
+		got := Resize(m, c.Spec).(*image.RGBA)
+		if got.Bounds() != want.Bounds() || !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%s -- differs from turning first", c.Spec)
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, c.W, c.H))
+		if err := ResizeInto(dst, m, ss); err != nil || !bytes.Equal(dst.Pix, want.Pix) {
+			t.Errorf("%s -- ResizeInto differs from turning first (%v)", c.Spec, err)
+		}
+		filtered := ResizeFilter(m, c.Spec, Nearest).(*image.RGBA)
+		if filtered.Bounds() != want.Bounds() {
+			t.Errorf("%s -- ResizeFilter bounds %v", c.Spec, filtered.Bounds())
+		}
+	}
+}
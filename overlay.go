@@ -0,0 +1,176 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"context"
+	"image"
+	"math"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// Gravity is where an overlay goes on the image.
+type Gravity int
+
+const (
+	GravityCenter Gravity = iota
+	GravityNorth
+	GravityNorthEast
+	GravityEast
+	GravitySouthEast
+	GravitySouth
+	GravitySouthWest
+	GravityWest
+	GravityNorthWest
+)
+
+// Overlay is an image, like a logo, that's drawn over images after
+// they're resized. Use it as a pointer (see Options.Overlay and
+// WithOverlay): it keeps the overlay scaled to each size it's been
+// used at, so it's only scaled once per size, and it's safe to use from
+// more than one goroutine. Don't change the fields once it's been used.
+type Overlay struct {
+	// Image is what's drawn.
+	Image image.Image
+	// Gravity is which edge or corner it's drawn against. The zero
+	// value is the middle.
+	Gravity Gravity
+	// Margin is the gap, in pixels of the output, between the overlay
+	// and the edges it's against. When tiling, it's the gap between
+	// the tiles.
+	Margin int
+	// Opacity is from 0 to 1. Zero means fully opaque, the same as 1.
+	Opacity float64
+	// Scale is the width of the overlay as a fraction of the width of
+	// the output, eg, 0.25 for a quarter of it. Zero means it's drawn
+	// at its own size.
+	Scale float64
+	// Tile repeats the overlay over the whole image, in a grid centred
+	// on it, eg, for watermarking previews. Gravity is ignored.
+	Tile bool
+
+	mu     sync.Mutex
+	scaled map[image.Point]*image.RGBA
+}
+
+// the most sizes an Overlay keeps. they're small, but an image can be
+// resized to any width.
+const maxOverlaySizes = 64
+
+// Draw draws the overlay onto dst, which is usually a resized image.
+func (self *Overlay) Draw(dst draw.Image) {
+	b := dst.Bounds()
+	if self.Image == nil || b.Empty() {
+		return
+	}
+	m := self.forWidth(b.Dx())
+	if m == nil {
+		return
+	}
+	size := m.Bounds().Size()
+	for _, p := range self.positions(b, size) {
+		draw.Draw(dst, image.Rectangle{p, p.Add(size)}, m, image.Point{}, draw.Over)
+	}
+}
+
+// positions returns the top left corners to draw an overlay of size at
+// on an image with bounds b
+func (self *Overlay) positions(b image.Rectangle, size image.Point) []image.Point {
+	margin := self.Margin
+	if !self.Tile {
+		x := b.Min.X + (b.Dx()-size.X)/2
+		switch self.Gravity {
+		case GravityWest, GravityNorthWest, GravitySouthWest:
+			x = b.Min.X + margin
+		case GravityEast, GravityNorthEast, GravitySouthEast:
+			x = b.Max.X - size.X - margin
+		}
+		y := b.Min.Y + (b.Dy()-size.Y)/2
+		switch self.Gravity {
+		case GravityNorth, GravityNorthWest, GravityNorthEast:
+			y = b.Min.Y + margin
+		case GravitySouth, GravitySouthWest, GravitySouthEast:
+			y = b.Max.Y - size.Y - margin
+		}
+		return []image.Point{{x, y}}
+	}
+	// start from the tile in the middle and go back to the first
+	// one that's (at least partly) on the image
+	step := size.Add(image.Pt(margin, margin))
+	if step.X <= 0 || step.Y <= 0 {
+		return nil
+	}
+	first := func(min, length, tile, step int) int {
+		p := min + (length-tile)/2
+		return p - (p-min+tile-1)/step*step
+	}
+	var points []image.Point
+	for y := first(b.Min.Y, b.Dy(), size.Y, step.Y); y < b.Max.Y; y += step.Y {
+		for x := first(b.Min.X, b.Dx(), size.X, step.X); x < b.Max.X; x += step.X {
+			points = append(points, image.Pt(x, y))
+		}
+	}
+	return points
+}
+
+// forWidth returns the overlay scaled for an output w pixels wide, with
+// the opacity applied, making it if it isn't cached
+func (self *Overlay) forWidth(w int) *image.RGBA {
+	src := self.Image.Bounds()
+	if src.Empty() {
+		return nil
+	}
+	size := src.Size()
+	if self.Scale > 0 {
+		size.X = int(math.Max(1, math.Round(self.Scale*float64(w))))
+		size.Y = scaleDimension(src.Dy(), size.X, src.Dx())
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if m, ok := self.scaled[size]; ok {
+		return m
+	}
+	m := image.NewRGBA(image.Rectangle{Max: size})
+	switch {
+	case size == src.Size():
+		draw.Draw(m, m.Bounds(), self.Image, src.Min, draw.Src)
+	case size.X < src.Dx():
+		plan := ResizePlan{Source: src, Crop: src, Width: size.X, Height: size.Y}
+		resizeInto(context.Background(), m, self.Image, plan, 1)
+	default:
+		// the box filter is blocky when it enlarges
+		draw.CatmullRom.Scale(m, m.Bounds(), self.Image, src, draw.Src, nil)
+	}
+	if self.Opacity > 0 && self.Opacity < 1 {
+		// it's premultiplied, so every channel fades together
+		for i, v := range m.Pix {
+			m.Pix[i] = uint8(float64(v)*self.Opacity + 0.5)
+		}
+	}
+	if self.scaled == nil || len(self.scaled) >= maxOverlaySizes {
+		self.scaled = make(map[image.Point]*image.RGBA)
+	}
+	self.scaled[size] = m
+	return m
+}
+
+// applyOverlay draws o onto a resized image, converting it to RGBA
+// first if it can't be drawn on
+func applyOverlay(m image.Image, o *Overlay) image.Image {
+	if o == nil {
+		return m
+	}
+	dst, ok := m.(draw.Image)
+	if !ok {
+		b := m.Bounds()
+		rgba := image.NewRGBA(b)
+		draw.Draw(rgba, b, m, b.Min, draw.Src)
+		dst = rgba
+	}
+	o.Draw(dst)
+	return dst
+}
@@ -0,0 +1,173 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"sync"
+	"testing"
+)
+
+type overlayPositionTestCase struct {
+	Gravity  Gravity
+	Expected image.Point
+}
+
+func Test_OverlayPositions(t *testing.T) {
+	b := image.Rect(10, 20, 110, 70)
+	size := image.Pt(20, 10)
+	cases := []overlayPositionTestCase{
+		{GravityCenter, image.Pt(50, 40)},
+		{GravityNorth, image.Pt(50, 25)},
+		{GravityNorthEast, image.Pt(85, 25)},
+		{GravityEast, image.Pt(85, 40)},
+		{GravitySouthEast, image.Pt(85, 55)},
+		{GravitySouth, image.Pt(50, 55)},
+		{GravitySouthWest, image.Pt(15, 55)},
+		{GravityWest, image.Pt(15, 40)},
+		{GravityNorthWest, image.Pt(15, 25)},
+	}
+	for _, c := range cases {
+		o := &Overlay{Gravity: c.Gravity, Margin: 5}
+		got := o.positions(b, size)
+		if len(got) != 1 || got[0] != c.Expected {
+			t.Errorf("%d -- got %v, expected %v", c.Gravity, got, c.Expected)
+		}
+	}
+
+	// tiles are centred, with every part of the image covered
+	o := &Overlay{Tile: true, Margin: 5}
+	tiles := o.positions(b, size)
+	centre := false
+	for _, p := range tiles {
+		if p == image.Pt(50, 40) {
+			centre = true
+		}
+		if !image.Rect(p.X, p.Y, p.X+size.X, p.Y+size.Y).Overlaps(b) {
+			t.Error("tile", p, "is off the image")
+		}
+	}
+	if !centre {
+		t.Error("no tile in the middle", tiles)
+	}
+	// every 25 across and 15 down from 50,40
+	if len(tiles) != 5*3 {
+		t.Error("expected 15 tiles, got", len(tiles), tiles)
+	}
+}
+
+func solidImage(r image.Rectangle, c color.Color) *image.RGBA {
+	m := image.NewRGBA(r)
+	draw.Draw(m, r, image.NewUniform(c), image.Point{}, draw.Src)
+	return m
+}
+
+func Test_OverlayDraw(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	logo := solidImage(image.Rect(0, 0, 40, 20), red)
+
+	// scaled to a fifth of the width, in the bottom right
+	dst := solidImage(image.Rect(0, 0, 100, 50), color.White)
+	o := &Overlay{Image: logo, Gravity: GravitySouthEast, Margin: 5, Scale: 0.2}
+	o.Draw(dst)
+	if dst.RGBAAt(94, 44) != red || dst.RGBAAt(75, 40) != red {
+		t.Error("overlay not drawn", dst.RGBAAt(94, 44), dst.RGBAAt(75, 40))
+	}
+	if dst.RGBAAt(95, 44) != (color.RGBA{255, 255, 255, 255}) || dst.RGBAAt(74, 44) != (color.RGBA{255, 255, 255, 255}) {
+		t.Error("overlay is too big")
+	}
+	if dst.RGBAAt(80, 34) != (color.RGBA{255, 255, 255, 255}) {
+		t.Error("overlay is too tall")
+	}
+
+	// half transparent
+	dst = solidImage(image.Rect(0, 0, 100, 50), color.White)
+	(&Overlay{Image: logo, Opacity: 0.5}).Draw(dst)
+	if c := dst.RGBAAt(50, 25); c.R != 255 || c.G < 126 || c.G > 128 || c.A != 255 {
+		t.Error("bad blend", c)
+	}
+
+	// enlarged, and on a non-RGBA image
+	gray := image.NewGray(image.Rect(0, 0, 100, 100))
+	(&Overlay{Image: solidImage(image.Rect(0, 0, 4, 4), color.White), Scale: 0.5}).Draw(gray)
+	if gray.GrayAt(50, 50).Y != 255 || gray.GrayAt(24, 50).Y != 0 || gray.GrayAt(25, 50).Y != 255 {
+		t.Error("bad enlarged overlay", gray.GrayAt(24, 50), gray.GrayAt(25, 50))
+	}
+}
+
+func Test_OverlayCache(t *testing.T) {
+	o := &Overlay{Image: solidImage(image.Rect(0, 0, 40, 20), color.Black), Scale: 0.1}
+	a := o.forWidth(200)
+	if o.forWidth(200) != a {
+		t.Error("same width wasn't cached")
+	}
+	if o.forWidth(204) != a {
+		t.Error("widths that make the same size should share")
+	}
+	if b := o.forWidth(400); b == a || b.Bounds().Dx() != 40 {
+		t.Error("bad overlay for a different width", b.Bounds())
+	}
+	for w := 1; w < 2*maxOverlaySizes; w++ {
+		o.forWidth(w * 10)
+	}
+	if len(o.scaled) > maxOverlaySizes {
+		t.Error("cache grew to", len(o.scaled))
+	}
+}
+
+func Test_ResizeOverlay(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	o := &Overlay{Image: solidImage(image.Rect(0, 0, 10, 10), red), Gravity: GravityNorthWest, Scale: 0.1}
+	r := New(WithOverlay(o))
+	src := solidImage(image.Rect(0, 0, 400, 200), color.White)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := r.ResizeMany(src, []string{"200w", "100w", "50s"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for spec, m := range out {
+				w := m.Bounds().Dx()
+				rgba := m.(*image.RGBA)
+				if rgba.RGBAAt(0, 0) != red || rgba.RGBAAt(w/10-1, 0) != red || rgba.RGBAAt(w/10, 0) == red {
+					t.Error(spec, "-- overlay wasn't drawn at a tenth of the width")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(o.scaled) != 3 {
+		t.Error("expected an overlay per size, got", len(o.scaled))
+	}
+}
+
+func Test_StreamOverlayColorManaged(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, solid(color.RGBA{50, 50, 50, 255}), &jpeg.Options{Quality: 100})
+	jpg := embedMetadata(buf.Bytes(), "jpeg", &metadata{icc: buildICC(adobeColorants, 2.2, false)})
+
+	// the overlay is already sRGB, so the profile shouldn't touch it
+	logo := color.RGBA{100, 200, 100, 255}
+	o := &Overlay{Image: solidImage(image.Rect(0, 0, 10, 10), logo), Scale: 0.5}
+	var out bytes.Buffer
+	if _, err := ResizeStream(&out, bytes.NewReader(jpg), "full", &Options{ColorManage: true, Overlay: o, Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := m.Bounds()
+	got := color.RGBAModel.Convert(m.At(b.Dx()/2, b.Dy()/2)).(color.RGBA)
+	if !near(got.R, logo.R, 1) || !near(got.G, logo.G, 1) || !near(got.B, logo.B, 1) {
+		t.Error("overlay colour changed to", got, "expected", logo)
+	}
+}
@@ -0,0 +1,79 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// PaletteOptions control how ResizePaletted (and ResizeStream, with
+// Options.Palette set) turn a resized image back into a paletted one.
+type PaletteOptions struct {
+	// Quantizer makes a new palette for the output, eg MedianCut{} or
+	// Octree{}. If it's nil, the source's own palette is used, if it
+	// had one, otherwise MedianCut.
+	Quantizer draw.Quantizer
+	// Colors is the most colours the Quantizer can use. The default,
+	// and the maximum, is 256.
+	Colors int
+	// Dither uses Floyd-Steinberg error diffusion when mapping pixels
+	// to the palette, rather than just picking the nearest colour.
+	Dither bool
+}
+
+// ResizePaletted resizes m like Resize but returns a paletted image,
+// which makes for much smaller PNGs and is what GIFs need anyway.
+func ResizePaletted(m image.Image, sizeStr string, opts *PaletteOptions) *image.Paletted {
+	out := Resize(m, sizeStr)
+	if out == nil {
+		return nil
+	}
+	return toPaletted(out, sourcePalette(m), opts)
+}
+
+// sourcePalette returns m's palette, if it has one
+func sourcePalette(m image.Image) color.Palette {
+	if p, ok := m.(*image.Paletted); ok {
+		return p.Palette
+	}
+	if p, ok := m.ColorModel().(color.Palette); ok {
+		return p
+	}
+	return nil
+}
+
+// toPaletted maps m onto pal, or onto a new palette if opts has a
+// Quantizer or pal is empty
+func toPaletted(m image.Image, pal color.Palette, opts *PaletteOptions) *image.Paletted {
+	if opts == nil {
+		opts = &PaletteOptions{}
+	}
+	q := opts.Quantizer
+	if q == nil && len(pal) == 0 {
+		q = MedianCut{}
+	}
+	if q != nil {
+		n := opts.Colors
+		if n <= 0 || n > 256 {
+			n = 256
+		}
+		pal = q.Quantize(make(color.Palette, 0, n), m)
+		if len(pal) == 0 {
+			// an empty image
+			pal = color.Palette{color.RGBA{}}
+		}
+	} else {
+		pal, _ = framePalette(pal, m)
+	}
+	b := m.Bounds()
+	p := image.NewPaletted(b, pal)
+	var d draw.Drawer = draw.Src
+	if opts.Dither {
+		d = draw.FloydSteinberg
+	}
+	d.Draw(p, b, m, b.Min)
+	return p
+}
@@ -0,0 +1,130 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+// testPalettedImage is 64x64 in four solid quarters, one transparent
+func testPalettedImage() *image.Paletted {
+	pal := color.Palette{
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 128, 0, 255},
+		color.RGBA{0, 0, 255, 255},
+		color.RGBA{0, 0, 0, 0},
+		// unused, so re-quantizing should be able to drop it
+		color.RGBA{10, 20, 30, 255},
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 64, 64), pal)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			m.SetColorIndex(x, y, uint8(x/32+2*(y/32)))
+		}
+	}
+	return m
+}
+
+func Test_ResizePalettedFastPath(t *testing.T) {
+	m := testPalettedImage()
+	rgba := image.NewRGBA(m.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), m, image.Point{}, draw.Src)
+	for _, s := range []string{"full", "10s", "33w", "20w10h"} {
+		if !sameImage(Resize(m, s), Resize(rgba, s)) {
+			t.Error(s, "-- paletted fast path differs from RGBA")
+		}
+	}
+}
+
+func Test_ResizePaletted(t *testing.T) {
+	m := testPalettedImage()
+	for _, opts := range []*PaletteOptions{
+		nil,
+		{Dither: true},
+		{Quantizer: MedianCut{}},
+		{Quantizer: Octree{}},
+		{Quantizer: MedianCut{}, Colors: 8, Dither: true},
+		{Quantizer: Octree{}, Colors: 8},
+	} {
+		out := ResizePaletted(m, "16s", opts)
+		if out.Bounds() != image.Rect(0, 0, 16, 16) {
+			t.Error(opts, "-- bad bounds", out.Bounds())
+			continue
+		}
+		if opts != nil && opts.Colors > 0 && len(out.Palette) > opts.Colors {
+			t.Error(opts, "-- palette too big", len(out.Palette))
+		}
+		// solid areas keep their colour
+		for _, p := range []struct {
+			x, y int
+			c    color.RGBA
+		}{
+			{2, 2, color.RGBA{255, 0, 0, 255}},
+			{13, 2, color.RGBA{0, 128, 0, 255}},
+			{2, 13, color.RGBA{0, 0, 255, 255}},
+			{13, 13, color.RGBA{0, 0, 0, 0}},
+		} {
+			got := color.RGBAModel.Convert(out.At(p.x, p.y)).(color.RGBA)
+			if got != p.c {
+				t.Error(opts, "-- pixel", p.x, p.y, "is", got, "expected", p.c)
+			}
+		}
+	}
+}
+
+func Test_Quantizers(t *testing.T) {
+	src := testPatternImage(64, 64)
+	for _, q := range []draw.Quantizer{MedianCut{}, Octree{}} {
+		for _, n := range []int{2, 16, 256} {
+			pal := q.Quantize(make(color.Palette, 0, n), src)
+			if len(pal) == 0 || len(pal) > n {
+				t.Errorf("%T %d -- bad palette size %d", q, n, len(pal))
+			}
+			seen := make(map[color.Color]bool)
+			for _, c := range pal {
+				if seen[c] {
+					t.Errorf("%T %d -- duplicate colour %v", q, n, c)
+				}
+				seen[c] = true
+			}
+		}
+		// a full palette has no room
+		full := make(color.Palette, 4)
+		if len(q.Quantize(full, src)) != 4 {
+			t.Errorf("%T -- shouldn't add to a full palette", q)
+		}
+		// mostly one colour, which sorts last
+		lopsided := solidImage(image.Rect(0, 0, 10, 10), color.RGBA{0, 0, 255, 255})
+		lopsided.SetRGBA(0, 0, color.RGBA{0, 0, 0, 255})
+		lopsided.SetRGBA(1, 0, color.RGBA{0, 0, 128, 255})
+		if pal := q.Quantize(make(color.Palette, 0, 256), lopsided); len(pal) != 3 {
+			t.Errorf("%T -- expected 3 colours, got %v", q, pal)
+		}
+	}
+}
+
+func Test_StreamPalette(t *testing.T) {
+	var src bytes.Buffer
+	png.Encode(&src, testPatternImage(64, 64))
+
+	var rgba, paletted bytes.Buffer
+	if _, err := ResizeStream(&rgba, bytes.NewReader(src.Bytes()), "32s", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResizeStream(&paletted, bytes.NewReader(src.Bytes()), "32s", &Options{Palette: &PaletteOptions{Quantizer: Octree{}, Colors: 16}}); err != nil {
+		t.Fatal(err)
+	}
+	if paletted.Len() >= rgba.Len() {
+		t.Error("paletted PNG should be smaller", paletted.Len(), rgba.Len())
+	}
+	m, err := png.Decode(&paletted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*image.Paletted); !ok {
+		t.Errorf("expected a paletted PNG, got %T", m)
+	}
+}
@@ -0,0 +1,261 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// both quantizers here implement image/draw's Quantizer interface, so
+// they can be used with anything in the standard library that takes
+// one (eg, gif.Options). fully transparent pixels always get a palette
+// entry of their own, so transparency survives quantizing.
+
+// colorCount is a colour and the number of pixels that have it
+type colorCount struct {
+	c [4]uint8
+	n uint64
+}
+
+// histogram returns the premultiplied colours used in m, without the
+// fully transparent ones, and whether there were any transparent ones
+func histogram(m image.Image) ([]colorCount, bool) {
+	counts := make(map[[4]uint8]uint64)
+	transparent := false
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
+			if c.A == 0 {
+				transparent = true
+				continue
+			}
+			counts[[4]uint8{c.R, c.G, c.B, c.A}]++
+		}
+	}
+	hist := make([]colorCount, 0, len(counts))
+	for c, n := range counts {
+		hist = append(hist, colorCount{c, n})
+	}
+	// map order is random, keep the output deterministic
+	sort.Slice(hist, func(i, j int) bool {
+		a, b := hist[i].c, hist[j].c
+		for k := 0; k < 4; k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return hist, transparent
+}
+
+// startPalette reserves the transparent entry, if there's room and
+// it's needed, and returns how many entries are left
+func startPalette(p color.Palette, transparent bool) (color.Palette, int) {
+	n := cap(p) - len(p)
+	if transparent && n > 0 {
+		p = append(p, color.RGBA{})
+		n--
+	}
+	return p, n
+}
+
+// MedianCut is a median cut colour quantizer. It repeatedly splits the
+// box of colours with the widest range in its widest channel, at the
+// median, then uses the average of each box.
+type MedianCut struct{}
+
+// Quantize appends up to cap(p) - len(p) colours for m to p.
+func (MedianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	hist, transparent := histogram(m)
+	p, n := startPalette(p, transparent)
+	if n <= 0 || len(hist) == 0 {
+		return p
+	}
+	boxes := [][]colorCount{hist}
+	for len(boxes) < n {
+		best, bestRange, bestChannel := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			ch, r := widestChannel(box)
+			if r > bestRange {
+				best, bestRange, bestChannel = i, r, ch
+			}
+		}
+		if best < 0 {
+			// every box is a single colour
+			break
+		}
+		a, b := splitBox(boxes[best], bestChannel)
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+	for _, box := range boxes {
+		p = append(p, averageColor(box))
+	}
+	return p
+}
+
+func widestChannel(box []colorCount) (int, int) {
+	channel, widest := 0, -1
+	for k := 0; k < 4; k++ {
+		lo, hi := 255, 0
+		for _, c := range box {
+			v := int(c.c[k])
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > widest {
+			channel, widest = k, hi-lo
+		}
+	}
+	return channel, widest
+}
+
+// splitBox splits a box at the median pixel along a channel. both
+// halves always get at least one colour.
+func splitBox(box []colorCount, channel int) ([]colorCount, []colorCount) {
+	sort.SliceStable(box, func(i, j int) bool { return box[i].c[channel] < box[j].c[channel] })
+	var total uint64
+	for _, c := range box {
+		total += c.n
+	}
+	var seen uint64
+	i := 0
+	for ; i < len(box)-2; i++ {
+		seen += box[i].n
+		if seen*2 >= total {
+			break
+		}
+	}
+	// new slices, so the halves don't share a backing array
+	a := append([]colorCount{}, box[:i+1]...)
+	b := append([]colorCount{}, box[i+1:]...)
+	return a, b
+}
+
+func averageColor(box []colorCount) color.Color {
+	var sum [4]uint64
+	var n uint64
+	for _, c := range box {
+		for k := 0; k < 4; k++ {
+			sum[k] += uint64(c.c[k]) * c.n
+		}
+		n += c.n
+	}
+	return color.RGBA{
+		uint8((sum[0] + n/2) / n),
+		uint8((sum[1] + n/2) / n),
+		uint8((sum[2] + n/2) / n),
+		uint8((sum[3] + n/2) / n),
+	}
+}
+
+// Octree is an octree colour quantizer. Colours are sorted into a tree
+// by the bits of their red, green and blue values, then the least used
+// branches are merged, deepest first, until there are few enough leaves.
+// It's usually faster than MedianCut and better at keeping small areas
+// of distinct colour.
+type Octree struct{}
+
+type octreeNode struct {
+	children [8]*octreeNode
+	leaf     bool
+	n        uint64
+	sum      [4]uint64
+}
+
+const octreeDepth = 8
+
+// Quantize appends up to cap(p) - len(p) colours for m to p.
+func (Octree) Quantize(p color.Palette, m image.Image) color.Palette {
+	hist, transparent := histogram(m)
+	p, n := startPalette(p, transparent)
+	if n <= 0 || len(hist) == 0 {
+		return p
+	}
+	root := &octreeNode{}
+	// inner nodes at each level, to reduce from the bottom up
+	var levels [octreeDepth][]*octreeNode
+	leaves := 0
+	for _, c := range hist {
+		node := root
+		root.n += c.n
+		for level := 0; level < octreeDepth; level++ {
+			shift := uint(7 - level)
+			i := (c.c[0]>>shift&1)<<2 | (c.c[1]>>shift&1)<<1 | (c.c[2] >> shift & 1)
+			if node.children[i] == nil {
+				node.children[i] = &octreeNode{}
+				if level == octreeDepth-1 {
+					node.children[i].leaf = true
+					leaves++
+				} else {
+					levels[level+1] = append(levels[level+1], node.children[i])
+				}
+			}
+			node = node.children[i]
+			node.n += c.n
+		}
+		for k := 0; k < 4; k++ {
+			node.sum[k] += uint64(c.c[k]) * c.n
+		}
+	}
+	levels[0] = []*octreeNode{root}
+
+	for level := octreeDepth - 1; level >= 0 && leaves > n; level-- {
+		nodes := levels[level]
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].n < nodes[j].n })
+		for _, node := range nodes {
+			if leaves <= n {
+				break
+			}
+			merged := 0
+			for i, child := range node.children {
+				if child == nil {
+					continue
+				}
+				for k := 0; k < 4; k++ {
+					node.sum[k] += child.sum[k]
+				}
+				node.children[i] = nil
+				merged++
+			}
+			node.leaf = true
+			leaves -= merged - 1
+		}
+	}
+
+	var collect func(node *octreeNode)
+	collect = func(node *octreeNode) {
+		if node.leaf {
+			// n is the number of pixels under the node
+			total := node.n
+			if total > 0 {
+				p = append(p, color.RGBA{
+					uint8((node.sum[0] + total/2) / total),
+					uint8((node.sum[1] + total/2) / total),
+					uint8((node.sum[2] + total/2) / total),
+					uint8((node.sum[3] + total/2) / total),
+				})
+			}
+			return
+		}
+		for _, child := range node.children {
+			if child != nil {
+				collect(child)
+			}
+		}
+	}
+	collect(root)
+	return p
+}
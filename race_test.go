@@ -0,0 +1,6 @@
+//go:build race
+
+package resize
+
+// sync.Pool drops things at random under the race detector
+const raceEnabled = true
@@ -4,11 +4,19 @@
 package resize
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"math"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 type SizeSpec struct {
@@ -16,6 +24,11 @@ type SizeSpec struct {
 	height int
 	square bool
 	full   bool
+	crop   *cropRegion
+	sharp  *SharpenOptions
+	orient Orientation
+	trim   *TrimOptions
+	bg     color.Color
 }
 
 // sizes are specified with a short string that can look like
@@ -32,46 +45,232 @@ type SizeSpec struct {
 // if 'full' or 's' are specified, they will take precedent over
 // width and height specs.
 //
+// the size can be combined with other components, separated by '-' or '/':
+//   crop:10,20,800,600/200w - first restrict the source to the 800x600
+//                             region at 10,20, then make it 200 wide
+//   crop:0.1,0.1,0.5,0.5-100s - same, with the region given as fractions
+//                               of the source's width and height
+//   200w-sharp - sharpen after resizing, by an amount that suits how much
+//                the image was scaled down
+//   200w-sharp:0.6,0.8,2 - sharpen with an amount, radius and threshold
+//                          (see SharpenOptions), the last two optional
+//   r90-200w - rotate 90 degrees clockwise (or r180, r270), then make it
+//              200 wide
+//   fh-100s - flip horizontally (or fv for vertically), then make a
+//             100 pixel square
+//   trim-100s - trim off any border (see TrimOptions), then make a 100
+//               pixel square of what's left
+//   trim:ffffff,10-100s - trim white borders, with a tolerance of 10
+//   200w-bgffffff - put anything transparent on a white background
+//                   (the colour is RRGGBB, or RRGGBBAA, in hex)
+// trimming happens first, then rotations and flips, in the order
+// they're given, so any crop region and the cropping to fit the size
+// are worked out on the trimmed and turned image.
+// if there are other components but no size, it's treated as 'full'.
+//
 // see Test_MakeSizeSpec in resize_test.go for more examples
 
 func MakeSizeSpec(str string) *SizeSpec {
 	s := SizeSpec{}
+	options := 0
+	var size []string
+	for _, part := range strings.FieldsFunc(str, isSpecSeparator) {
+		switch {
+		case strings.HasPrefix(part, "crop:"):
+			if c, ok := parseCropRegion(part[len("crop:"):]); ok {
+				s.crop = c
+			}
+			options++
+		case part == "sharp" || strings.HasPrefix(part, "sharp:"):
+			if sh, ok := parseSharpen(strings.TrimPrefix(strings.TrimPrefix(part, "sharp"), ":")); ok {
+				s.sharp = sh
+			}
+			options++
+		case part == "trim" || strings.HasPrefix(part, "trim:"):
+			if t, ok := parseTrim(strings.TrimPrefix(strings.TrimPrefix(part, "trim"), ":")); ok {
+				s.trim = t
+			}
+			options++
+		case strings.HasPrefix(part, "bg"):
+			if c, ok := parseBackground(part[len("bg"):]); ok {
+				s.bg = c
+			}
+			options++
+		case orientationTokens[part] != 0:
+			s.orient = s.orient.then(orientationTokens[part])
+			options++
+		default:
+			size = append(size, part)
+		}
+	}
+	if len(size) == 0 && options > 0 {
+		size = append(size, "full")
+	}
+	s.parseSize(strings.Join(size, "-"))
+	return &s
+}
+
+func isSpecSeparator(r rune) bool {
+	return r == '-' || r == '/'
+}
+
+var (
+	squareRe = regexp.MustCompile(`\d+s`)
+	widthRe  = regexp.MustCompile(`\d+w`)
+	heightRe = regexp.MustCompile(`\d+h`)
+)
+
+// parseSize fills in the dimensions from the size component of a spec
+func (self *SizeSpec) parseSize(str string) {
 	if str == "full" {
-		s.full = true
-		s.width = -1
-		s.height = -1
-		return &s
+		self.full = true
+		self.width = -1
+		self.height = -1
+		return
 	}
-	r, _ := regexp.Compile("\\d+s")
-	if m := r.FindString(str); m != "" {
+	if m := squareRe.FindString(str); m != "" {
 		w, _ := strconv.Atoi(m[:len(m)-1])
-		s.width = w
-		s.height = w
-		s.square = true
-		return &s
+		self.width = w
+		self.height = w
+		self.square = true
+		return
 	}
 	// not full size or square, so we need to parse individual dimensions
-	s.square = false
-	s.full = false
+	self.square = false
+	self.full = false
 
-	r, _ = regexp.Compile("\\d+w")
-	if m := r.FindString(str); m != "" {
+	if m := widthRe.FindString(str); m != "" {
 		w, _ := strconv.Atoi(m[:len(m)-1])
-		s.width = w
+		self.width = w
 	} else {
 		// width was not set
-		s.width = -1
+		self.width = -1
 	}
-	r, _ = regexp.Compile("\\d+h")
-	if m := r.FindString(str); m != "" {
+	if m := heightRe.FindString(str); m != "" {
 		h, _ := strconv.Atoi(m[:len(m)-1])
-		s.height = h
+		self.height = h
 	} else {
 		// height was not set
-		s.height = -1
+		self.height = -1
 	}
+}
 
-	return &s
+// cropRegion is a part of the source image to restrict a SizeSpec to,
+// before it does its own cropping and scaling. x and y are relative to
+// the source's bounds, so 0,0 is always the top left of the source.
+type cropRegion struct {
+	x, y, w, h float64
+	// if normalized, the values are fractions of the source's
+	// width and height rather than pixels
+	normalized bool
+}
+
+// parseCropRegion parses "x,y,width,height". if any of the values has
+// a decimal point and they are all <= 1, it's a normalized region.
+func parseCropRegion(str string) (*cropRegion, bool) {
+	fields := strings.Split(str, ",")
+	if len(fields) != 4 {
+		return nil, false
+	}
+	var v [4]float64
+	normalized := false
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(f, 64)
+		if err != nil || x < 0 || math.IsInf(x, 0) || math.IsNaN(x) {
+			return nil, false
+		}
+		v[i] = x
+		if strings.Contains(f, ".") {
+			normalized = true
+		}
+	}
+	if v[2] <= 0 || v[3] <= 0 {
+		return nil, false
+	}
+	c := &cropRegion{x: v[0], y: v[1], w: v[2], h: v[3], normalized: normalized}
+	if normalized {
+		for _, x := range v {
+			if x > 1 {
+				return nil, false
+			}
+		}
+	} else {
+		// pixel regions are whole pixels
+		for _, x := range v {
+			if x != math.Trunc(x) {
+				return nil, false
+			}
+		}
+	}
+	return c, true
+}
+
+// rect returns the region as a rectangle inside src
+func (self *cropRegion) rect(src image.Rectangle) image.Rectangle {
+	var r image.Rectangle
+	if self.normalized {
+		dx, dy := float64(src.Dx()), float64(src.Dy())
+		r = image.Rect(
+			int(math.Round(self.x*dx)), int(math.Round(self.y*dy)),
+			int(math.Round((self.x+self.w)*dx)), int(math.Round((self.y+self.h)*dy)))
+	} else {
+		r = image.Rect(int(self.x), int(self.y), int(self.x+self.w), int(self.y+self.h))
+	}
+	return r.Add(src.Min).Intersect(src)
+}
+
+// isNoOp is true for a normalized region covering the whole source
+func (self *cropRegion) isNoOp() bool {
+	return self.normalized && self.x == 0 && self.y == 0 && self.w >= 1 && self.h >= 1
+}
+
+func (self *cropRegion) String() string {
+	if self.normalized {
+		f := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+		return "crop:" + f(self.x) + "," + f(self.y) + "," + f(self.w) + "," + f(self.h)
+	}
+	return fmt.Sprintf("crop:%d,%d,%d,%d", int(self.x), int(self.y), int(self.w), int(self.h))
+}
+
+// WithCrop returns a copy of the spec that first restricts the source
+// to r (relative to the source's top left corner) before cropping and
+// scaling. It's the same as a "crop:" component in the spec string.
+// Any part of r above or to the left of the source is left out.
+func (self SizeSpec) WithCrop(r image.Rectangle) *SizeSpec {
+	r = r.Canon()
+	// it would be clipped to the source anyway, and a negative
+	// origin can't be written in a spec string
+	r.Min.X, r.Min.Y = max(r.Min.X, 0), max(r.Min.Y, 0)
+	r.Max.X, r.Max.Y = max(r.Max.X, r.Min.X), max(r.Max.Y, r.Min.Y)
+	self.crop = &cropRegion{x: float64(r.Min.X), y: float64(r.Min.Y), w: float64(r.Dx()), h: float64(r.Dy())}
+	return &self
+}
+
+// WithNormalizedCrop is like WithCrop, but the region is given as
+// fractions of the source's width and height.
+func (self SizeSpec) WithNormalizedCrop(x, y, w, h float64) *SizeSpec {
+	// as for WithCrop. NaN ends up as 0 too
+	if !(x > 0) {
+		w, x = w+x, 0
+	}
+	if !(y > 0) {
+		h, y = h+y, 0
+	}
+	self.crop = &cropRegion{x: x, y: y, w: w, h: h, normalized: true}
+	return &self
+}
+
+// Region returns the part of src that the spec will operate on. That's
+// all of src unless the spec has a crop region. If the spec rotates or
+// flips the image, the region is in the coordinates of the turned
+// image, which has the same top left corner as src (and so does the
+// rectangle from ToRect).
+func (self SizeSpec) Region(src image.Rectangle) image.Rectangle {
+	src = self.orient.orientedBounds(src)
+	if self.crop == nil {
+		return src
+	}
+	return self.crop.rect(src)
 }
 
 func (self SizeSpec) IsSquare() bool {
@@ -99,7 +298,50 @@ func (self SizeSpec) ToImageMagickSpec() string {
 	return fmt.Sprintf("%dx%d", self.width, self.height)
 }
 
+// String returns the canonical form of the spec. See Canonical.
 func (self SizeSpec) String() string {
+	return self.Canonical()
+}
+
+// Canonical returns the normalized spec string. Specs that produce the
+// same output always have the same canonical form, so it's suitable for
+// use in cache keys:
+//
+//	full       - full size
+//	100s       - square
+//	200w100h   - width always comes before height
+//	200w, 100h - only one dimension constrained
+//
+// leading zeros are dropped ("0100w" becomes "100w") and anything that
+// wasn't understood by MakeSizeSpec is left out. Other components are
+// joined with '-': trimming, any rotation or flip (combined into at
+// most one of each), then a crop, then the size, sharpening and the
+// background last:
+//
+//	trim-r90-crop:10,20,800,600-200w-sharp-bgffffff
+func (self SizeSpec) Canonical() string {
+	var parts []string
+	if self.trim != nil {
+		parts = append(parts, self.trim.String())
+	}
+	if o := self.orient.specString(); o != "" {
+		parts = append(parts, o)
+	}
+	if self.crop != nil && !self.crop.isNoOp() {
+		parts = append(parts, self.crop.String())
+	}
+	parts = append(parts, self.sizeString())
+	if self.sharp != nil {
+		parts = append(parts, self.sharp.String())
+	}
+	if self.bg != nil {
+		parts = append(parts, "bg"+hexColor(self.bg))
+	}
+	return strings.Join(parts, "-")
+}
+
+// sizeString is the canonical form of just the size component
+func (self SizeSpec) sizeString() string {
 	if self.IsFull() {
 		return "full"
 	}
@@ -115,6 +357,13 @@ func (self SizeSpec) String() string {
 	return fmt.Sprintf("%dw%dh", self.width, self.height)
 }
 
+// Key returns a short, stable hash of the canonical form of the spec.
+// Two specs with the same Key will produce the same derivative.
+func (self SizeSpec) Key() string {
+	sum := sha1.Sum([]byte(self.Canonical()))
+	return hex.EncodeToString(sum[:])
+}
+
 func (self SizeSpec) IsFull() bool {
 	return self.full
 }
@@ -170,141 +419,404 @@ func rectIsSquare(r image.Rectangle) bool {
 // given an image size (as image.Rect), we match it up
 // to the SizeSpec and return a new image.Rect which is
 // essentially, the dimensions to crop the image to before scaling
+//
+// if the spec has a crop region, that's applied first. the returned
+// rectangle always lies inside it (including when rect doesn't start
+// at 0,0), is centered in it, and is as large as it can
+// be while having the aspect ratio of the spec.
 
 func (self *SizeSpec) ToRect(rect image.Rectangle) image.Rectangle {
+	rect = self.Region(rect)
 	if self.full || self.Width() == -1 || self.Height() == -1 {
 		// full-size or only scaling one dimension, means we deal with the whole thing
 		return rect
 	}
-
-	if self.square {
-		if rectIsSquare(rect) {
-			// already square. WIN.
-			return rect
-		}
-		if rectIsLandscape(rect) {
-			// crop and center on width
-			trim := (rect.Dx() - rect.Dy()) / 2
-			return image.Rect(trim, 0, rect.Dx()-trim, rect.Dy())
-		} else {
-			// portrait
-			// crop and center on height
-			trim := (rect.Dy() - rect.Dx()) / 2
-			return image.Rect(0, trim, rect.Dx(), rect.Dy()-trim)
-		}
-	}
-	if self.width == self.height {
+	if !self.square && self.width == self.height {
 		// "square" but not square.
 		// fit it in a box with a max dimension, but don't crop
-		// or scale up
-		// in other words, return the whole thing. TargetWH will have to deal.
+		// in other words, return the whole thing. TargetWH will deal.
 		return rect
 	}
-	// scaling both width and height
-	if self.IsLandscape() {
-		if rectIsSquare(rect) {
-			// keep width, trim height
-			ratio := float64(self.Height()) / float64(self.Width())
-			targetHeight := int(ratio * float64(rect.Dx()))
-			trim := targetHeight / 2
-			return image.Rect(0, trim, rect.Dx(), rect.Dy()-trim)
-		} else {
-			if rectIsLandscape(rect) {
-				ratio := float64(rect.Dy()) / float64(rect.Dx())
-				outRatio := float64(self.Height()) / float64(self.Width())
-				if ratio == outRatio {
-					return rect
-				}
-				if outRatio > ratio {
-					// want it even wider, so crop height
-				} else {
-					// narrower, so crop on width
-				}
-				rHeight := int(float64(rect.Dy()) * ratio)
-				trim := (rect.Dy() - rHeight) / 2
-				return image.Rect(0, trim, rect.Dx(), rect.Dy()-trim)
-			} else {
-				// rect.Dy() is the keeper
-				ratio := float64(rect.Dx()) / float64(self.Width())
-				rHeight := ratio * float64(self.Height())
-				trim := int((float64(rect.Dy()) - rHeight) / 2)
-				return image.Rect(0, trim, rect.Dx(), rect.Dy()-trim)
-			}
-		}
-	} else {
-		// portrait constraint
-		if rectIsSquare(rect) {
-			// keep height, trim width
-			ratio := float64(self.Width()) / float64(self.Height())
-			targetWidth := int(ratio * float64(rect.Dy()))
-			trim := (rect.Dx() - targetWidth) / 2
-			return image.Rect(trim, 0, rect.Dx()-trim, rect.Dx())
-		} else {
-			if rectIsLandscape(rect) {
-				ratio := float64(self.Width()) / float64(self.Height())
-				targetWidth := int(ratio * float64(rect.Dy()))
-				trim := (rect.Dx() - targetWidth) / 2
-				return image.Rect(trim, 0, rect.Dx()-trim, rect.Dy())
-			} else {
-				//rect.Dy() is the keeper
-				ratio := float64(rect.Dx()) / float64(self.Width())
-				rHeight := ratio * float64(self.Height())
-				trim := int((float64(rect.Dy()) - rHeight) / 2)
-				return image.Rect(0, trim, rect.Dx(), rect.Dy()-trim)
-			}
-		}
+	// square, or scaling both width and height. either way, crop to
+	// the aspect ratio of the spec
+	return cropToAspect(rect, self.width, self.height)
+}
 
+// cropToAspect returns the largest rectangle with an aspect ratio
+// of w:h that fits in rect, centered in it.
+func cropToAspect(rect image.Rectangle, w, h int) image.Rectangle {
+	dx, dy := int64(rect.Dx()), int64(rect.Dy())
+	if w <= 0 || h <= 0 || dx <= 0 || dy <= 0 {
+		return rect
+	}
+	tw, th := int64(w), int64(h)
+	cw, ch := dx, dy
+	if dx*th > dy*tw {
+		// source is wider than the spec, keep the height and trim width
+		cw = (dy*tw + th/2) / th
+	} else {
+		// source is taller than the spec (or the same), keep the width
+		// and trim height
+		ch = (dx*th + tw/2) / tw
+	}
+	if cw < 1 {
+		cw = 1
 	}
-	return rect
+	if ch < 1 {
+		ch = 1
+	}
+	// any odd pixel left over from the trim comes off the right/bottom
+	x := rect.Min.X + int((dx-cw)/2)
+	y := rect.Min.Y + int((dy-ch)/2)
+	return image.Rect(x, y, x+int(cw), y+int(ch))
 }
 
 // size of the image that will result from resizing one of the
 // specified rect to this SizeSpec
 func (self *SizeSpec) TargetWH(rect image.Rectangle) (int, int) {
+	rect = self.Region(rect)
 	if self.full {
 		return rect.Dx(), rect.Dy()
 	}
 	if self.square {
 		return self.width, self.height
 	}
+	if rect.Dx() <= 0 || rect.Dy() <= 0 {
+		return 0, 0
+	}
 	if self.width == -1 {
 		// scaling height only
-		ratio := float64(rect.Dy()) / float64(self.height)
-		x := int(float64(rect.Dx()) / ratio)
-		return x, self.height
+		return truncDimension(rect.Dx(), self.height, rect.Dy()), self.height
 	}
 	if self.height == -1 {
-		// scaling height only
-		ratio := float64(rect.Dx()) / float64(self.width)
-		x := int(float64(rect.Dy()) / ratio)
-		return self.width, x
+		// scaling width only
+		return self.width, truncDimension(rect.Dy(), self.width, rect.Dx())
+	}
+	if self.width == self.height {
+		// fit inside a box, preserving aspect ratio. never scale up.
+		if rect.Dx() <= self.width && rect.Dy() <= self.height {
+			return rect.Dx(), rect.Dy()
+		}
+		if rect.Dx() >= rect.Dy() {
+			return self.width, scaleDimension(rect.Dy(), self.width, rect.Dx())
+		}
+		return scaleDimension(rect.Dx(), self.height, rect.Dy()), self.height
 	}
 
 	return self.width, self.height
 }
 
-// Resize returns a scaled copy of the image slice r of m.
-// The returned image has width w and height h.
+// scaleDimension returns n scaled by num/den, rounded to the nearest
+// pixel. it never returns less than 1 pixel for a non-empty target.
+func scaleDimension(n, num, den int) int {
+	if num <= 0 {
+		return num
+	}
+	x := (int64(n)*int64(num) + int64(den)/2) / int64(den)
+	if x < 1 {
+		x = 1
+	}
+	return int(x)
+}
+
+// truncDimension is scaleDimension the way width or height only specs
+// have always worked it out, truncating rather than rounding, so the
+// images they make keep the sizes they've always had
+func truncDimension(n, num, den int) int {
+	if num <= 0 {
+		return num
+	}
+	ratio := float64(den) / float64(num)
+	x := int(float64(n) / ratio)
+	if x < 1 {
+		x = 1
+	}
+	return x
+}
+
+// ResizePlan describes everything a resize will do to an image of a
+// given size, without touching any pixels.
+type ResizePlan struct {
+	// Source is the bounds of the image the plan was made for.
+	Source image.Rectangle
+	// Crop is the part of Source that will be scaled.
+	Crop image.Rectangle
+	// Width and Height are the dimensions of the output image.
+	Width  int
+	Height int
+	// ScaleX and ScaleY are output pixels per cropped source pixel.
+	ScaleX float64
+	ScaleY float64
+	// Orientation is applied to the crop after it's been scaled, to
+	// make the output. The crop is in the source's own orientation,
+	// the output size and scales are the output's. Zero (or
+	// OrientationNormal) means none.
+	Orientation Orientation
+	// Upscale is true if either dimension gets scaled up.
+	Upscale bool
+	// NoOp is true if the output will be identical to the source.
+	NoOp bool
+	// Sharpen is the unsharp mask applied after scaling, with any
+	// adaptive settings worked out, or nil for none.
+	Sharpen *SharpenOptions
+	// sharpen is what was asked for, before that
+	sharpen *SharpenOptions
+	// Background, if it's set, is composited under the output, so
+	// nothing is transparent.
+	Background color.Color
+}
+
+// Plan works out the crop rectangle and output size for an image with
+// the bounds src. Resize executes exactly this plan (unless the spec
+// trims, see PlanImage), so it can be used ahead of decoding for
+// layout, HTML width/height attributes, etc.
+func (self *SizeSpec) Plan(src image.Rectangle) ResizePlan {
+	p := ResizePlan{Source: src, Orientation: self.orient}
+	p.Crop = self.orient.sourceRect(self.ToRect(src), src)
+	p.Width, p.Height = self.TargetWH(src)
+	p.setScale()
+	p.Upscale = p.ScaleX > 1 || p.ScaleY > 1
+	p.NoOp = p.Crop == src && p.Width == src.Dx() && p.Height == src.Dy() && !p.Orientation.transforms()
+	p.withSharpen(self.sharp)
+	if self.bg != nil {
+		p.Background = self.bg
+		p.NoOp = false
+	}
+	return p
+}
+
+// cropSize is the size of the crop turned the same way as the output
+func (self ResizePlan) cropSize() (int, int) {
+	if self.Orientation.SwapsAxes() {
+		return self.Crop.Dy(), self.Crop.Dx()
+	}
+	return self.Crop.Dx(), self.Crop.Dy()
+}
+
+// scaledSize is the size the crop is scaled to, before it's turned to
+// make the output
+func (self ResizePlan) scaledSize() (int, int) {
+	if self.Orientation.SwapsAxes() {
+		return self.Height, self.Width
+	}
+	return self.Width, self.Height
+}
+
+// setScale works out the scales from the crop and output size
+func (self *ResizePlan) setScale() {
+	cw, ch := self.cropSize()
+	if cw > 0 {
+		self.ScaleX = float64(self.Width) / float64(cw)
+	}
+	if ch > 0 {
+		self.ScaleY = float64(self.Height) / float64(ch)
+	}
+}
+
+// withSharpen sets the sharpening for the plan
+func (self *ResizePlan) withSharpen(s *SharpenOptions) {
+	self.sharpen = s
+	self.Sharpen = s.resolve(self.ScaleX, self.ScaleY)
+	if self.Sharpen != nil {
+		self.NoOp = false
+	}
+}
+
+// withoutUpscale shrinks the output of a plan that would enlarge its
+// crop until it doesn't, keeping the output's aspect ratio
+func (self ResizePlan) withoutUpscale() ResizePlan {
+	if !self.Upscale {
+		return self
+	}
+	cw, ch := self.cropSize()
+	if int64(cw)*int64(self.Height) < int64(ch)*int64(self.Width) {
+		// the width is what stops it growing
+		self.Height = scaleDimension(self.Height, cw, self.Width)
+		self.Width = cw
+	} else {
+		self.Width = scaleDimension(self.Width, ch, self.Height)
+		self.Height = ch
+	}
+	self.setScale()
+	self.Upscale = false
+	self.NoOp = self.Crop == self.Source && self.Width == cw && self.Height == ch && !self.Orientation.transforms()
+	self.withSharpen(self.sharpen)
+	return self
+}
+
+// shrunk adjusts a plan for a copy of the source that's been shrunk by
+// scale, to bounds. The output size stays the same, only the crop
+// shrinks. Partial pixels at the edges of the shrunk copy count as
+// whole ones, as they do when a JPEG is decoded at a reduced scale.
+func (self ResizePlan) shrunk(scale int, bounds image.Rectangle) ResizePlan {
+	if scale <= 1 {
+		return self
+	}
+	s := scale
+	c := self.Crop.Sub(self.Source.Min)
+	self.Source = bounds
+	self.Crop = image.Rect(c.Min.X/s, c.Min.Y/s, (c.Max.X+s-1)/s, (c.Max.Y+s-1)/s).
+		Add(bounds.Min).Intersect(bounds)
+	if self.Crop.Dx() > 0 && self.Crop.Dy() > 0 {
+		self.setScale()
+	}
+	self.NoOp = false
+	return self
+}
+
+// maxShrink returns the biggest power of two that the source could be
+// shrunk by and still leave the crop at least margin times the size of
+// the output in both directions. It's 1 if it can't be shrunk at all.
+func (self ResizePlan) maxShrink(margin float64) int {
+	w, h := self.scaledSize()
+	if w <= 0 || h <= 0 {
+		return 1
+	}
+	s := 1
+	for float64(self.Crop.Dx()/(2*s)) >= margin*float64(w) &&
+		float64(self.Crop.Dy()/(2*s)) >= margin*float64(h) {
+		s *= 2
+	}
+	return s
+}
+
+// Resize returns a scaled copy of m, cropped and scaled
+// according to the size spec in sizeStr. m's bounds don't have to
+// start at 0,0 (eg, the result of SubImage), the returned image's
+// always do.
+//
+// It's a thin wrapper around a Resizer with the default options (see
+// New), which has more control and reports errors.
 func Resize(m image.Image, sizeStr string) image.Image {
-	var w, h int
+	// the only error without limits or a context is an invalid spec,
+	// which has always been a nil image here
+	out, _ := defaultResizer.Resize(m, sizeStr)
+	return out
+}
 
+// ResizeContext is like Resize, but gives up and returns ctx.Err() if
+// ctx is done before it's finished. Where Resize would return nil for
+// an invalid spec, it returns ErrInvalidSpec.
+func ResizeContext(ctx context.Context, m image.Image, sizeStr string) (image.Image, error) {
+	return ResizeParallel(ctx, m, sizeStr, 1)
+}
+
+// ResizeParallel is like ResizeContext, but splits the work between
+// workers goroutines. Zero (or less) means one per CPU. The output is
+// exactly the same as Resize's. If ctx is done, all the workers stop.
+func ResizeParallel(ctx context.Context, m image.Image, sizeStr string, workers int) (image.Image, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
 	ss := MakeSizeSpec(sizeStr)
-	r := ss.ToRect(m.Bounds())
-	w, h = ss.TargetWH(m.Bounds())
+	return resizePlanContext(ctx, m, ss.PlanImage(m), workers)
+}
+
+// resizePlan carries out plan on m
+func resizePlan(m image.Image, plan ResizePlan) image.Image {
+	// nothing can cancel the background context, so the only error
+	// is an invalid plan, which Resize has always reported as nil
+	out, _ := resizePlanContext(context.Background(), m, plan, 1)
+	return out
+}
+
+// ResizeInto resizes src according to ss, like Resize, but writes the
+// result into dst instead of allocating a new image. dst's bounds must
+// be the size in the plan (see SizeSpec.Plan), though they don't have
+// to start at 0,0. Buffers are reused between calls, so with an
+// *image.RGBA destination and a spec that's only parsed once, there's
+// next to no garbage.
+func ResizeInto(dst draw.Image, src image.Image, ss *SizeSpec) error {
+	plan := ss.PlanImage(src)
+	if plan.Width < 0 || plan.Height < 0 {
+		return ErrInvalidSpec
+	}
+	if b := dst.Bounds(); b.Dx() != plan.Width || b.Dy() != plan.Height {
+		return ErrWrongSize
+	}
+	if err := resizeInto(context.Background(), dst, src, plan, 1); err != nil {
+		return err
+	}
+	sharpenInto(dst, plan.Sharpen)
+	flattenInto(dst, plan.Background)
+	return nil
+}
+
+// resizePlanContext carries out plan on m with the given number of
+// workers, stopping early if ctx is done
+func resizePlanContext(ctx context.Context, m image.Image, plan ResizePlan, workers int) (image.Image, error) {
+	r := plan.Crop
+	w, h := plan.Width, plan.Height
 
 	if w < 0 || h < 0 {
-		return nil
+		return nil, ErrInvalidSpec
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
-		return image.NewRGBA64(r)
+		return image.NewRGBA64(r.Sub(r.Min)), nil
 	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	if err := resizeInto(ctx, out, m, plan, workers); err != nil {
+		return nil, err
+	}
+	sharpenRGBA(out, plan.Sharpen)
+	flattenRGBA(out, plan.Background)
+	return out, nil
+}
+
+// resizeInto carries out plan on m, writing the result to dst, which
+// has to be the right size
+func resizeInto(ctx context.Context, dst draw.Image, m image.Image, plan ResizePlan, workers int) error {
+	r := plan.Crop
+	w, h := plan.Width, plan.Height
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
+		return nil
+	}
+	rows, scale := rowsFor(m, r)
+	if plan.Orientation.transforms() {
+		// scale, then turn the (smaller) result
+		sw, sh := plan.scaledSize()
+		tmp := image.NewRGBA(image.Rect(0, 0, sw, sh))
+		if err := resizeBox(ctx, tmp, r, scale, rows, workers); err != nil {
+			return err
+		}
+		orientInto(dst, tmp, plan.Orientation)
+		return nil
+	}
+	return resizeBox(ctx, dst, r, scale, rows, workers)
+}
 
+// rowsFor returns the fastest rowReader for the r part of m, and how
+// much it scales values up from 8 bits
+func rowsFor(m image.Image, r image.Rectangle) (rowReader, uint64) {
 	switch m := m.(type) {
 	case *image.RGBA:
-		return resizeRGBA(m, r, w, h)
+		return rgbaRows(m, r), 1
+	case *image.Paletted:
+		return palettedRows(m, r), 1
 	}
-	ww, hh := uint64(w), uint64(h)
-	dx, dy := uint64(r.Dx()), uint64(r.Dy())
+	return genericRows(m, r), 0x0101
+}
+
+// rowReader fills buf with the premultiplied red, green, blue and alpha
+// values of the pixels in row y of the source, from r.Min.X to r.Max.X.
+// it has to be safe to call from more than one goroutine.
+type rowReader func(y int, buf []uint64)
+
+// how many source rows get summed between checks for cancellation
+const cancelCheckRows = 64
+
+// resizeBox scales the r part of the source read by rows into dst.
+// scale is how much the values from rows are scaled up from 8 bits.
+// with more than one worker, the output rows are split into bands that
+// are summed at the same time.
+func resizeBox(ctx context.Context, dst draw.Image, r image.Rectangle, scale uint64, rows rowReader, workers int) error {
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
 	// The scaling algorithm is to nearest-neighbor magnify the dx * dy source
 	// to a (ww*dx) * (hh*dy) intermediate image and then minify the intermediate
 	// image back down to a ww * hh destination with a simple box filter.
@@ -333,34 +845,102 @@ func Resize(m image.Image, sizeStr string) image.Image {
 	// step 1 first and all of step 2 second, we could allocate a smaller sum
 	// slice of length 4*w*2 instead of 4*w*h, although the resultant code
 	// would become more complicated.
-	n, sum := dx*dy, make([]uint64, 4*w*h)
-	for y := r.Min.Y; y < r.Max.Y; y++ {
-		for x := r.Min.X; x < r.Max.X; x++ {
-			// Get the source pixel.
-			r32, g32, b32, a32 := m.At(x, y).RGBA()
-			r64 := uint64(r32)
-			g64 := uint64(g32)
-			b64 := uint64(b32)
-			a64 := uint64(a32)
+	n := uint64(r.Dx()) * uint64(r.Dy())
+	sums := sumBuffers.get(4 * w * h)
+	defer sumBuffers.put(sums)
+	sum := *sums
+	for i := range sum {
+		sum[i] = 0
+	}
+	if workers > h {
+		workers = h
+	}
+	if workers <= 1 {
+		if err := sumBand(ctx, r, w, h, 0, h, rows, sum); err != nil {
+			return err
+		}
+		average(dst, sum, n*scale)
+		return nil
+	}
+
+	// each worker has its own band of output rows, so they never
+	// write to the same sums
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func(j0, j1 int) {
+			err := sumBand(ctx, r, w, h, j0, j1, rows, sum)
+			if err != nil {
+				// no point the others carrying on
+				cancel()
+			}
+			errs <- err
+		}(i*h/workers, (i+1)*h/workers)
+	}
+	var err error
+	for i := 0; i < workers; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	average(dst, sum, n*scale)
+	return nil
+}
+
+// sumBand does the summing for output rows j0 to j1 of resizeBox. only
+// the source rows that touch those output rows are read, and source
+// rows on the edge of the band only add to the sums inside it.
+func sumBand(ctx context.Context, r image.Rectangle, w, h, j0, j1 int, rows rowReader, sum []uint64) error {
+	ww, hh := uint64(w), uint64(h)
+	dx, dy := uint64(r.Dx()), uint64(r.Dy())
+	// the band, in rows of the intermediate image
+	lo, hi := uint64(j0)*dy, uint64(j1)*dy
+	y0, y1 := int(lo/hh), int((hi+hh-1)/hh)
+	bufp := rowBuffers.get(4 * r.Dx())
+	defer rowBuffers.put(bufp)
+	buf := *bufp
+	for y := y0; y < y1; y++ {
+		if (y-y0)%cancelCheckRows == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		// Get the source pixels.
+		rows(r.Min.Y+y, buf)
+		// the part of the band this source row covers
+		top, bottom := uint64(y)*hh, uint64(y+1)*hh
+		if top < lo {
+			top = lo
+		}
+		if bottom > hi {
+			bottom = hi
+		}
+		for x := 0; x < r.Dx(); x++ {
+			p := buf[4*x : 4*x+4]
 			// Spread the source pixel over 1 or more destination rows.
-			py := uint64(y-r.Min.Y) * hh
-			for remy := hh; remy > 0; {
+			py := top
+			for remy := bottom - top; remy > 0; {
 				qy := dy - (py % dy)
 				if qy > remy {
 					qy = remy
 				}
 				// Spread the source pixel over 1 or more destination columns.
-				px := uint64(x-r.Min.X) * ww
+				px := uint64(x) * ww
 				index := 4 * ((py/dy)*ww + (px / dx))
 				for remx := ww; remx > 0; {
 					qx := dx - (px % dx)
 					if qx > remx {
 						qx = remx
 					}
-					sum[index+0] += r64 * qx * qy
-					sum[index+1] += g64 * qx * qy
-					sum[index+2] += b64 * qx * qy
-					sum[index+3] += a64 * qx * qy
+					qxy := qx * qy
+					sum[index+0] += p[0] * qxy
+					sum[index+1] += p[1] * qxy
+					sum[index+2] += p[2] * qxy
+					sum[index+3] += p[3] * qxy
 					index += 4
 					px += qx
 					remx -= qx
@@ -370,91 +950,125 @@ func Resize(m image.Image, sizeStr string) image.Image {
 			}
 		}
 	}
-	return average(sum, w, h, n*0x0101)
+	return nil
 }
 
-// average convert the sums to averages and returns the result.
-func average(sum []uint64, w, h int, n uint64) image.Image {
-	r := image.Rect(0, 0, w, h)
-	ret := image.NewRGBA(r)
+// average converts the sums to averages and writes them to dst
+func average(dst draw.Image, sum []uint64, n uint64) {
+	b := dst.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if rgba, ok := dst.(*image.RGBA); ok {
+		for y := 0; y < h; y++ {
+			row := rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y+y):][:4*w]
+			s := sum[4*w*y:][:4*w]
+			for i := range row {
+				row[i] = uint8(s[i] / n)
+			}
+		}
+		return
+	}
 	for y := 0; y < h; y++ {
 		for x := 0; x < w; x++ {
-			i := y*ret.Stride + x*4
 			j := 4 * (y*w + x)
-			ret.Pix[i+0] = uint8(sum[j+0] / n)
-			ret.Pix[i+1] = uint8(sum[j+1] / n)
-			ret.Pix[i+2] = uint8(sum[j+2] / n)
-			ret.Pix[i+3] = uint8(sum[j+3] / n)
+			dst.Set(b.Min.X+x, b.Min.Y+y, color.RGBA{
+				uint8(sum[j+0] / n),
+				uint8(sum[j+1] / n),
+				uint8(sum[j+2] / n),
+				uint8(sum[j+3] / n),
+			})
 		}
 	}
-	return ret
 }
 
-// resizeRGBA returns a scaled copy of the RGBA image slice r of m.
-// The returned image has width w and height h.
-func resizeRGBA(m *image.RGBA, r image.Rectangle, w, h int) image.Image {
-	ww, hh := uint64(w), uint64(h)
-	dx, dy := uint64(r.Dx()), uint64(r.Dy())
-	// See comment in Resize.
-	n, sum := dx*dy, make([]uint64, 4*w*h)
-	for y := r.Min.Y; y < r.Max.Y; y++ {
-		pix := m.Pix[(y-m.Rect.Min.Y)*m.Stride:]
+// bufferPool reuses the sum and row buffers in resizeBox. they're big
+// and short lived, so reusing them saves a lot of garbage on a busy
+// server. sums and rows are kept apart, or they'd keep displacing each
+// other.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+var sumBuffers, rowBuffers bufferPool
+
+// get returns a buffer of length n from the pool, or a new one. it
+// isn't cleared.
+func (self *bufferPool) get(n int) *[]uint64 {
+	if p, ok := self.pool.Get().(*[]uint64); ok {
+		if cap(*p) >= n {
+			*p = (*p)[:n]
+			return p
+		}
+		// too small, let it go rather than keep it around
+	}
+	buf := make([]uint64, n)
+	return &buf
+}
+
+func (self *bufferPool) put(p *[]uint64) {
+	self.pool.Put(p)
+}
+
+// genericRows reads rows from any image, with 16 bit values
+func genericRows(m image.Image, r image.Rectangle) rowReader {
+	return func(y int, buf []uint64) {
 		for x := r.Min.X; x < r.Max.X; x++ {
-			// Get the source pixel.
-			p := pix[(x-m.Rect.Min.X)*4:]
-			r64 := uint64(p[0])
-			g64 := uint64(p[1])
-			b64 := uint64(p[2])
-			a64 := uint64(p[3])
-			// Spread the source pixel over 1 or more destination rows.
-			py := uint64(y-r.Min.Y) * hh
-			for remy := hh; remy > 0; {
-				qy := dy - (py % dy)
-				if qy > remy {
-					qy = remy
-				}
-				// Spread the source pixel over 1 or more destination columns.
-				px := uint64(x-r.Min.X) * ww
-				index := 4 * ((py/dy)*ww + (px / dx))
-				for remx := ww; remx > 0; {
-					qx := dx - (px % dx)
-					if qx > remx {
-						qx = remx
-					}
-					qxy := qx * qy
-					sum[index+0] += r64 * qxy
-					sum[index+1] += g64 * qxy
-					sum[index+2] += b64 * qxy
-					sum[index+3] += a64 * qxy
-					index += 4
-					px += qx
-					remx -= qx
-				}
-				py += qy
-				remy -= qy
-			}
+			r32, g32, b32, a32 := m.At(x, y).RGBA()
+			i := 4 * (x - r.Min.X)
+			buf[i+0] = uint64(r32)
+			buf[i+1] = uint64(g32)
+			buf[i+2] = uint64(b32)
+			buf[i+3] = uint64(a32)
+		}
+	}
+}
+
+// rgbaRows reads rows straight out of an RGBA image's pixels
+func rgbaRows(m *image.RGBA, r image.Rectangle) rowReader {
+	return func(y int, buf []uint64) {
+		pix := m.Pix[m.PixOffset(r.Min.X, y):]
+		for i := range buf {
+			buf[i] = uint64(pix[i])
+		}
+	}
+}
+
+// palettedRows reads rows from a paletted image, looking colours up
+// in a copy of the palette that's already been converted
+func palettedRows(m *image.Paletted, r image.Rectangle) rowReader {
+	var pal [256][4]uint64
+	for i, c := range m.Palette {
+		if i >= len(pal) {
+			break
+		}
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		pal[i] = [4]uint64{uint64(rgba.R), uint64(rgba.G), uint64(rgba.B), uint64(rgba.A)}
+	}
+	return func(y int, buf []uint64) {
+		pix := m.Pix[m.PixOffset(r.Min.X, y):]
+		for x := 0; x < r.Dx(); x++ {
+			copy(buf[4*x:4*x+4], pal[pix[x]][:])
 		}
 	}
-	return average(sum, w, h, n)
 }
 
 // Resample returns a resampled copy of the image slice r of m.
-// The returned image has width w and height h.
+// The returned image has width w and height h, and its bounds
+// start at 0,0 wherever r is.
 // plain old Nearest Neighbor algorithm
 func Resample(m image.Image, r image.Rectangle, w, h int) image.Image {
 	if w < 0 || h < 0 {
 		return nil
 	}
 	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
-		return image.NewRGBA64(r)
+		return image.NewRGBA64(r.Sub(r.Min))
 	}
 	curw, curh := r.Dx(), r.Dy()
-	img := image.NewRGBA(r)
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
 	for y := 0; y < h; y++ {
 		for x := 0; x < w; x++ {
-			// Get a source pixel.
-			subx := x * curw / w
-			suby := y * curh / h
+			// Get a source pixel. r may not start at 0,0
+			subx := r.Min.X + x*curw/w
+			suby := r.Min.Y + y*curh/h
 			r32, g32, b32, a32 := m.At(subx, suby).RGBA()
 			r := uint8(r32 >> 8)
 			g := uint8(g32 >> 8)
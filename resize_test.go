@@ -1,8 +1,14 @@
 package resize
 
 import (
+	"context"
 	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
 )
 
 type SizeSpecTestCase struct {
@@ -317,3 +323,500 @@ func Test_ToRect(t *testing.T) {
 	}
 
 }
+
+func Test_Canonical(t *testing.T) {
+	cases := []struct {
+		A, B string
+	}{
+		{"100h200w", "200w100h"},
+		{"200h100w", "100w200h"},
+		{"0100w", "100w"},
+		{"100s", "0100s"},
+		{"full", "full"},
+	}
+	for _, c := range cases {
+		a := MakeSizeSpec(c.A)
+		b := MakeSizeSpec(c.B)
+		if a.Canonical() != b.Canonical() {
+			t.Error(c.A, c.B, "-- should have the same canonical form", a.Canonical(), b.Canonical())
+		}
+		if a.Key() != b.Key() {
+			t.Error(c.A, c.B, "-- should have the same key")
+		}
+	}
+
+	if MakeSizeSpec("100w").Key() == MakeSizeSpec("100h").Key() {
+		t.Error("100w and 100h should not have the same key")
+	}
+	if MakeSizeSpec("100s").Key() == MakeSizeSpec("100w100h").Key() {
+		t.Error("100s and 100w100h should not have the same key")
+	}
+}
+
+func Test_Plan(t *testing.T) {
+	landscape := image.Rect(0, 0, 1000, 500)
+
+	p := MakeSizeSpec("100s").Plan(landscape)
+	if p.Crop.Dx() != 500 || p.Crop.Dy() != 500 {
+		t.Error("100s -- bad crop", p.Crop)
+	}
+	if p.Width != 100 || p.Height != 100 {
+		t.Error("100s -- bad output size", p.Width, p.Height)
+	}
+	if p.ScaleX != 0.2 || p.ScaleY != 0.2 {
+		t.Error("100s -- bad scale", p.ScaleX, p.ScaleY)
+	}
+	if p.Upscale || p.NoOp {
+		t.Error("100s -- should be a plain downscale", p)
+	}
+
+	p = MakeSizeSpec("full").Plan(landscape)
+	if !p.NoOp || p.Upscale {
+		t.Error("full -- should be a no-op", p)
+	}
+
+	p = MakeSizeSpec("2000w").Plan(landscape)
+	if !p.Upscale || p.NoOp {
+		t.Error("2000w -- should upscale", p)
+	}
+	if p.Width != 2000 || p.Height != 1000 {
+		t.Error("2000w -- bad output size", p.Width, p.Height)
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for _, s := range []string{"10s", "20w", "15h", "20w10h", "10w20h", "full"} {
+		p := MakeSizeSpec(s).Plan(m.Bounds())
+		out := Resize(m, s)
+		if out.Bounds().Dx() != p.Width || out.Bounds().Dy() != p.Height {
+			t.Error(s, "-- Resize output", out.Bounds(), "doesn't match plan", p.Width, p.Height)
+		}
+	}
+}
+
+func Test_ToRectOddAndOffset(t *testing.T) {
+	// odd trims shouldn't lose a pixel
+	r := MakeSizeSpec("100s").ToRect(image.Rect(0, 0, 1001, 500))
+	if r != image.Rect(250, 0, 750, 500) {
+		t.Error("odd trim -- bad crop", r)
+	}
+	// non-zero origins
+	src := image.Rect(100, 200, 1100, 700)
+	r = MakeSizeSpec("100s").ToRect(src)
+	if r != image.Rect(350, 200, 850, 700) {
+		t.Error("offset square -- bad crop", r)
+	}
+	r = MakeSizeSpec("100h50w").ToRect(image.Rect(-50, -50, 950, 950))
+	if r != image.Rect(200, -50, 700, 950) {
+		t.Error("offset portrait on square -- bad crop", r)
+	}
+	// landscape spec on a landscape image that's not wide enough
+	r = MakeSizeSpec("300w100h").ToRect(image.Rect(0, 0, 1000, 500))
+	if r.Dx() != 1000 || r.Dy() != 333 {
+		t.Error("landscape on less-landscape -- bad crop", r)
+	}
+	// and one that's too wide
+	r = MakeSizeSpec("150w100h").ToRect(image.Rect(0, 0, 1000, 500))
+	if r.Dx() != 750 || r.Dy() != 500 {
+		t.Error("landscape on more-landscape -- bad crop", r)
+	}
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func Test_ToRectProperties(t *testing.T) {
+	f := func(sw, sh, tw, th uint16, ox, oy int16, square bool) bool {
+		src := image.Rect(0, 0, 1+int(sw)%5000, 1+int(sh)%5000).Add(image.Pt(int(ox), int(oy)))
+		w, h := 1+int(tw)%2000, 1+int(th)%2000
+		ss := &SizeSpec{width: w, height: h}
+		if square {
+			ss = &SizeSpec{width: w, height: w, square: true}
+			h = w
+		}
+		if !square && w == h {
+			// box fit, no crop
+			return ss.ToRect(src) == src
+		}
+		r := ss.ToRect(src)
+		if r.Empty() || !r.In(src) {
+			t.Log("crop", r, "not inside", src)
+			return false
+		}
+		// centered, to within a pixel
+		if abs64(int64(r.Min.X-src.Min.X)-int64(src.Max.X-r.Max.X)) > 1 ||
+			abs64(int64(r.Min.Y-src.Min.Y)-int64(src.Max.Y-r.Max.Y)) > 1 {
+			t.Log("crop", r, "not centered in", src)
+			return false
+		}
+		// as big as possible, with the spec's aspect ratio to within a pixel
+		// (if the crop is all of src, either dimension can be the kept one)
+		cw, ch := int64(r.Dx()), int64(r.Dy())
+		if r.Dx() != src.Dx() && r.Dy() != src.Dy() {
+			t.Log("crop", r, "doesn't use a full dimension of", src)
+			return false
+		}
+		if r.Dx() == src.Dx() && abs64(ch*int64(w)-cw*int64(h)) <= int64(w) {
+			return true
+		}
+		if r.Dy() == src.Dy() && abs64(cw*int64(h)-ch*int64(w)) <= int64(h) {
+			return true
+		}
+		t.Log("crop", r, "wrong aspect for", w, h)
+		return false
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_TargetWHBoxProperties(t *testing.T) {
+	f := func(sw, sh, box uint16) bool {
+		src := image.Rect(0, 0, 1+int(sw)%5000, 1+int(sh)%5000)
+		b := 1 + int(box)%2000
+		ss := &SizeSpec{width: b, height: b}
+		w, h := ss.TargetWH(src)
+		if w > b || h > b || w < 1 || h < 1 {
+			return false
+		}
+		if w > src.Dx() || h > src.Dy() {
+			// never scales up
+			return false
+		}
+		// aspect preserved to within a pixel
+		if src.Dx() >= src.Dy() {
+			return abs64(int64(h)*int64(src.Dx())-int64(w)*int64(src.Dy())) <= int64(src.Dx())
+		}
+		return abs64(int64(w)*int64(src.Dy())-int64(h)*int64(src.Dx())) <= int64(src.Dy())
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// width or height only specs truncate, as they always have, so the
+// sizes of images that have already been made don't change
+func Test_TargetWHOneDimension(t *testing.T) {
+	cases := []struct {
+		spec string
+		src  image.Rectangle
+		w, h int
+	}{
+		{"200w", image.Rect(0, 0, 1000, 333), 200, 66},
+		{"200h", image.Rect(0, 0, 333, 1000), 66, 200},
+		{"100w", image.Rect(0, 0, 300, 200), 100, 66},
+		{"100w", image.Rect(0, 0, 150, 100), 100, 66},
+		{"10w", image.Rect(0, 0, 5000, 10), 10, 1},
+	}
+	for _, c := range cases {
+		if w, h := MakeSizeSpec(c.spec).TargetWH(c.src); w != c.w || h != c.h {
+			t.Error(c.spec, c.src, "-- got", w, h, "expected", c.w, c.h)
+		}
+	}
+}
+
+// testPattern fills m with something that isn't uniform, so crops
+// and offsets that are off by a pixel show up in the output.
+func testPattern(m draw.Image) {
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			m.Set(x, y, color.NRGBA{uint8(x * 7), uint8(y * 13), uint8((x + y) * 3), uint8(128 + (x*y)%128)})
+		}
+	}
+}
+
+func testPatternImage(w, h int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	testPattern(m)
+	return m
+}
+
+// rebase returns a copy of m, of the same type, with its bounds
+// moved to 0,0
+func rebase(m image.Image) image.Image {
+	b := m.Bounds()
+	var out draw.Image
+	switch m.(type) {
+	case *image.NRGBA:
+		out = image.NewNRGBA(b.Sub(b.Min))
+	default:
+		out = image.NewRGBA(b.Sub(b.Min))
+	}
+	draw.Draw(out, out.Bounds(), m, b.Min, draw.Src)
+	return out
+}
+
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if color.RGBAModel.Convert(a.At(x, y)) != color.RGBAModel.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func Test_SubImage(t *testing.T) {
+	type subImager interface {
+		draw.Image
+		SubImage(image.Rectangle) image.Image
+	}
+	sources := []subImager{
+		image.NewRGBA(image.Rect(0, 0, 97, 61)),
+		image.NewNRGBA(image.Rect(0, 0, 97, 61)),
+		image.NewRGBA(image.Rect(-20, 13, 77, 74)),
+	}
+	specs := []string{"full", "10s", "20w", "15h", "20w10h", "10w20h", "12w12h"}
+	for _, src := range sources {
+		testPattern(src)
+		b := src.Bounds()
+		for _, sr := range []image.Rectangle{
+			image.Rect(b.Min.X+11, b.Min.Y+5, b.Min.X+70, b.Min.Y+40),
+			image.Rect(b.Min.X+3, b.Min.Y+9, b.Min.X+30, b.Min.Y+60),
+		} {
+			sub := src.SubImage(sr)
+			flat := rebase(sub)
+			for _, s := range specs {
+				if !sameImage(Resize(sub, s), Resize(flat, s)) {
+					t.Errorf("%T %v %s -- sub-image resize differs from re-based copy", src, sr, s)
+				}
+			}
+			if !sameImage(Resample(sub, sub.Bounds(), 13, 7), Resample(flat, flat.Bounds(), 13, 7)) {
+				t.Errorf("%T %v -- sub-image resample differs from re-based copy", src, sr)
+			}
+		}
+	}
+}
+
+func Test_CropRegion(t *testing.T) {
+	ss := MakeSizeSpec("crop:10,20,800,600/200w")
+	if ss.Width() != 200 || ss.Height() != -1 {
+		t.Error("crop -- bad size", ss.Width(), ss.Height())
+	}
+	if ss.Canonical() != "crop:10,20,800,600-200w" {
+		t.Error("crop -- bad canonical form", ss.Canonical())
+	}
+	if MakeSizeSpec(ss.Canonical()).Key() != ss.Key() {
+		t.Error("crop -- canonical form doesn't round trip")
+	}
+	if ss.Key() != MakeSizeSpec("200w").WithCrop(image.Rect(10, 20, 810, 620)).Key() {
+		t.Error("crop -- WithCrop should match the spec string")
+	}
+	// a negative origin can't be written in a spec, but it'd be
+	// clipped off anyway
+	neg := MakeSizeSpec("100s").WithCrop(image.Rect(-10, -10, 60, 60))
+	if neg.Canonical() != "crop:0,0,60,60-100s" || MakeSizeSpec(neg.Canonical()).Key() != neg.Key() {
+		t.Error("crop -- negative origin should be clamped", neg.Canonical())
+	}
+	if c := MakeSizeSpec("100s").WithNormalizedCrop(-0.25, 0, 0.75, 1).Canonical(); c != "crop:0,0,0.5,1-100s" {
+		t.Error("normalized crop -- negative origin should be clamped", c)
+	}
+
+	src := image.Rect(100, 100, 1100, 1100)
+	if r := ss.Region(src); r != image.Rect(110, 120, 910, 720) {
+		t.Error("crop -- bad region", r)
+	}
+	p := ss.Plan(src)
+	if p.Crop != image.Rect(110, 120, 910, 720) || p.Width != 200 || p.Height != 150 {
+		t.Error("crop -- bad plan", p)
+	}
+	// the region gets clipped to the source
+	if r := ss.Region(image.Rect(0, 0, 400, 300)); r != image.Rect(10, 20, 400, 300) {
+		t.Error("crop -- region should be clipped", r)
+	}
+
+	ss = MakeSizeSpec("crop:0.25,0.5,0.5,0.5-100s")
+	if r := ss.ToRect(image.Rect(0, 0, 1000, 400)); r != image.Rect(400, 200, 600, 400) {
+		t.Error("normalized crop -- bad rect", r)
+	}
+	if ss.Canonical() != "crop:0.25,0.5,0.5,0.5-100s" {
+		t.Error("normalized crop -- bad canonical form", ss.Canonical())
+	}
+	if MakeSizeSpec("crop:0.0,0,1,1.0-100s").Canonical() != "100s" {
+		t.Error("whole-image crop should drop out of the canonical form")
+	}
+	if MakeSizeSpec("crop:10,10,50,50").Canonical() != "crop:10,10,50,50-full" {
+		t.Error("crop with no size should be full size")
+	}
+	for _, bad := range []string{"crop:1,2,3-100s", "crop:0,0,0,10-100s", "crop:a,b,c,d-100s", "crop:0.5,0,2.5,1-100s", "crop:NaN,0.1,0.5,0.5-100s"} {
+		if MakeSizeSpec(bad).Canonical() != "100s" {
+			t.Error(bad, "-- bad crop should be ignored", MakeSizeSpec(bad).Canonical())
+		}
+	}
+
+	// resizing with a crop region is the same as resizing the sub-image
+	m := image.NewRGBA(image.Rect(0, 0, 120, 90))
+	testPattern(m)
+	sub := m.SubImage(image.Rect(10, 20, 90, 80))
+	for _, s := range []string{"full", "20s", "30w", "10w20h"} {
+		if !sameImage(Resize(m, "crop:10,20,80,60/"+s), Resize(sub, s)) {
+			t.Error(s, "-- crop region resize differs from sub-image resize")
+		}
+	}
+}
+
+func Test_ResizeParallel(t *testing.T) {
+	src := testPatternImage(97, 61)
+	sub := src.SubImage(image.Rect(5, 3, 90, 58))
+	paletted := image.NewPaletted(src.Bounds(), palette.Plan9)
+	draw.Draw(paletted, paletted.Bounds(), src, image.Point{}, draw.Src)
+	nrgba := image.NewNRGBA(src.Bounds())
+	testPattern(nrgba)
+	for _, m := range []image.Image{src, sub, paletted, nrgba} {
+		for _, s := range []string{"full", "10s", "20w", "15h", "3w", "200w", "50w200h", "60s"} {
+			want := Resize(m, s)
+			for _, workers := range []int{0, 1, 2, 3, 7, 1000} {
+				got, err := ResizeParallel(context.Background(), m, s, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !sameImage(got, want) {
+					t.Errorf("%T %s %d -- parallel resize differs", m, s, workers)
+				}
+			}
+		}
+	}
+	if _, err := ResizeContext(context.Background(), src, "nonsense"); err != ErrInvalidSpec {
+		t.Error("expected ErrInvalidSpec, got", err)
+	}
+}
+
+// cancellingImage cancels a context once a number of rows have been
+// read from it, and counts the rows read after that
+type cancellingImage struct {
+	*image.NRGBA
+	cancel     func()
+	rows       int64
+	after      int64
+	afterwards int64
+}
+
+func (self *cancellingImage) At(x, y int) color.Color {
+	if x == self.Bounds().Min.X {
+		if atomic.AddInt64(&self.rows, 1) > self.after {
+			self.cancel()
+			atomic.AddInt64(&self.afterwards, 1)
+		}
+	}
+	return self.NRGBA.At(x, y)
+}
+
+func Test_ResizeContextCancel(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 50, 2000))
+	testPattern(src)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ResizeContext(ctx, src, "10s"); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		m := &cancellingImage{NRGBA: src, cancel: cancel, after: 100}
+		out, err := ResizeParallel(ctx, m, "10w", workers)
+		if err != context.Canceled || out != nil {
+			t.Error(workers, "-- expected context.Canceled, got", err)
+		}
+		// every worker can finish the rows it's on before it notices
+		if limit := int64(workers * cancelCheckRows); m.afterwards > limit {
+			t.Error(workers, "-- read", m.afterwards, "rows after being cancelled, expected at most", limit)
+		}
+	}
+}
+
+func Test_ResizeInto(t *testing.T) {
+	src := testPatternImage(97, 61)
+	for _, s := range []string{"10s", "20w", "15h", "200w", "crop:10,10,30,20-full"} {
+		ss := MakeSizeSpec(s)
+		want := Resize(src, s)
+		b := want.Bounds()
+		// anywhere, and any type
+		for _, dst := range []draw.Image{
+			image.NewRGBA(b),
+			image.NewRGBA(b.Add(image.Pt(-7, 30))),
+			image.NewRGBA64(b.Add(image.Pt(3, 4))),
+		} {
+			if err := ResizeInto(dst, src, ss); err != nil {
+				t.Fatal(s, err)
+			}
+			if !sameImage(rebase(dst), want) {
+				t.Errorf("%s %T %v -- differs from Resize", s, dst, dst.Bounds())
+			}
+		}
+		// and again, with a destination full of junk from last time
+		dst := image.NewRGBA(b)
+		for i := range dst.Pix {
+			dst.Pix[i] = 0xff
+		}
+		ResizeInto(dst, src, ss)
+		if !sameImage(dst, want) {
+			t.Errorf("%s -- a dirty destination should be overwritten", s)
+		}
+	}
+	if err := ResizeInto(image.NewRGBA(image.Rect(0, 0, 10, 11)), src, MakeSizeSpec("10s")); err != ErrWrongSize {
+		t.Error("expected ErrWrongSize, got", err)
+	}
+	if err := ResizeInto(image.NewRGBA(image.Rect(0, 0, 10, 10)), src, MakeSizeSpec("nonsense")); err != ErrInvalidSpec {
+		t.Error("expected ErrInvalidSpec, got", err)
+	}
+}
+
+func Test_ResizeIntoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the pools don't hold on to buffers with the race detector on")
+	}
+	src := testPatternImage(400, 300)
+	ss := MakeSizeSpec("100w")
+	dst := image.NewRGBA(image.Rect(0, 0, 100, 75))
+	allocs := testing.AllocsPerRun(20, func() {
+		ResizeInto(dst, src, ss)
+	})
+	// just the row reader, the buffers all come from the pools
+	if allocs > 2 {
+		t.Error("expected next to no allocations, got", allocs)
+	}
+}
+
+func BenchmarkResize(b *testing.B) {
+	src := testPatternImage(1200, 800)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Resize(src, "200w")
+	}
+}
+
+func BenchmarkResizeInto(b *testing.B) {
+	src := testPatternImage(1200, 800)
+	ss := MakeSizeSpec("200w")
+	dst := image.NewRGBA(image.Rect(0, 0, 200, 133))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ResizeInto(dst, src, ss); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResizeParallel(b *testing.B) {
+	src := testPatternImage(1200, 800)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ResizeParallel(ctx, src, "200w", 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"runtime"
+
+	"golang.org/x/image/draw"
+)
+
+// Resizer resizes images with a fixed set of options, so they can be
+// set up once (eg, when a server starts) instead of being passed to
+// every call. Make one with New. A Resizer is safe to use from more
+// than one goroutine.
+//
+// The package level functions, like Resize, use a Resizer with the
+// default options.
+type Resizer struct {
+	opts Options
+}
+
+// Option configures a Resizer. See New.
+type Option func(*Resizer)
+
+// New returns a Resizer with the given options. With none, it behaves
+// just like the package level functions:
+//
+//	r := resize.New(resize.WithFilter(draw.CatmullRom), resize.WithMaxPixels(50000000))
+func New(options ...Option) *Resizer {
+	r := &Resizer{}
+	for _, o := range options {
+		o(r)
+	}
+	return r
+}
+
+// WithFilter scales with filter instead of the box filter. See
+// ResizeFilter.
+func WithFilter(filter draw.Scaler) Option {
+	return func(r *Resizer) { r.opts.Filter = filter }
+}
+
+// WithWorkers splits each resize between n goroutines. Zero (or less)
+// means one per CPU. See ResizeParallel.
+func WithWorkers(n int) Option {
+	return func(r *Resizer) {
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		r.opts.Workers = n
+	}
+}
+
+// WithLimits checks every image against limits. See Limits.
+func WithLimits(limits Limits) Option {
+	return func(r *Resizer) { r.opts.Limits = &limits }
+}
+
+// WithMaxPixels limits the size of source images to n pixels, keeping
+// any other limits that have been set.
+func WithMaxPixels(n int64) Option {
+	return func(r *Resizer) {
+		limits := Limits{}
+		if r.opts.Limits != nil {
+			limits = *r.opts.Limits
+		}
+		limits.MaxSourcePixels = n
+		r.opts.Limits = &limits
+	}
+}
+
+// WithoutUpscaling stops images from being made bigger than they are.
+// See Options.NoUpscale.
+func WithoutUpscaling() Option {
+	return func(r *Resizer) { r.opts.NoUpscale = true }
+}
+
+// WithSharpen sharpens images after resizing, unless the spec says
+// how to itself. See SharpenOptions.
+func WithSharpen(opts SharpenOptions) Option {
+	return func(r *Resizer) { r.opts.Sharpen = &opts }
+}
+
+// WithOverlay draws o over every image after it's resized. See
+// Overlay.
+func WithOverlay(o *Overlay) Option {
+	return func(r *Resizer) { r.opts.Overlay = o }
+}
+
+// WithBackground sets the colour that transparent images are put on
+// for JPEG output. See Options.Background.
+func WithBackground(c color.Color) Option {
+	return func(r *Resizer) { r.opts.Background = c }
+}
+
+// WithFormat sets the output format for the stream methods: "jpeg",
+// "png" or "gif". By default the source's format is kept.
+func WithFormat(format string) Option {
+	return func(r *Resizer) { r.opts.Format = format }
+}
+
+// WithJPEGQuality sets the JPEG quality (1-100) for the stream methods.
+func WithJPEGQuality(quality int) Option {
+	return func(r *Resizer) { r.opts.JPEGQuality = quality }
+}
+
+// WithColorManagement converts images with an ICC profile to sRGB in
+// the stream methods. See Options.ColorManage.
+func WithColorManagement() Option {
+	return func(r *Resizer) { r.opts.ColorManage = true }
+}
+
+// WithMetadata sets which metadata the stream methods keep.
+func WithMetadata(policy MetadataPolicy) Option {
+	return func(r *Resizer) { r.opts.Metadata = policy }
+}
+
+// WithOptions starts from a full set of stream Options. Options after
+// it change that copy, options before it are overwritten.
+func WithOptions(opts Options) Option {
+	return func(r *Resizer) { r.opts = opts }
+}
+
+// Plan works out what resizing an image with bounds src to sizeStr
+// will do, following the Resizer's options. Like SizeSpec.Plan, it
+// can't allow for trimming.
+func (self *Resizer) Plan(src image.Rectangle, sizeStr string) ResizePlan {
+	return self.opts.plan(MakeSizeSpec(sizeStr), src)
+}
+
+// Resize returns m cropped and scaled according to sizeStr. It returns
+// ErrInvalidSpec for a spec that doesn't make an image, and a
+// *LimitError if the Resizer has limits and m or the output is over
+// them.
+func (self *Resizer) Resize(m image.Image, sizeStr string) (image.Image, error) {
+	return self.ResizeSpecContext(context.Background(), m, MakeSizeSpec(sizeStr))
+}
+
+// ResizeContext is Resize, stopping early with ctx.Err() if ctx is
+// done before it's finished.
+func (self *Resizer) ResizeContext(ctx context.Context, m image.Image, sizeStr string) (image.Image, error) {
+	return self.ResizeSpecContext(ctx, m, MakeSizeSpec(sizeStr))
+}
+
+// ResizeSpec is Resize with a spec that's already been parsed.
+func (self *Resizer) ResizeSpec(m image.Image, ss *SizeSpec) (image.Image, error) {
+	return self.ResizeSpecContext(context.Background(), m, ss)
+}
+
+// ResizeSpecContext is ResizeSpec, stopping early with ctx.Err() if ctx
+// is done before it's finished.
+func (self *Resizer) ResizeSpecContext(ctx context.Context, m image.Image, ss *SizeSpec) (image.Image, error) {
+	b := m.Bounds()
+	if err := self.opts.Limits.CheckConfig(image.Config{ColorModel: m.ColorModel(), Width: b.Dx(), Height: b.Dy()}); err != nil {
+		return nil, err
+	}
+	plan := self.opts.planImage(ss, m)
+	if err := self.opts.Limits.CheckPlan(plan); err != nil {
+		return nil, err
+	}
+	return self.opts.resize(ctx, m, plan)
+}
+
+// ResizeStream is the package level ResizeStream, with the Resizer's
+// options.
+func (self *Resizer) ResizeStream(dst io.Writer, src io.Reader, sizeStr string) (*Result, error) {
+	return self.ResizeStreamContext(context.Background(), dst, src, sizeStr)
+}
+
+// ResizeStreamContext is the package level ResizeStreamContext, with the
+// Resizer's options.
+func (self *Resizer) ResizeStreamContext(ctx context.Context, dst io.Writer, src io.Reader, sizeStr string) (*Result, error) {
+	opts := self.opts
+	return ResizeStreamContext(ctx, dst, src, sizeStr, &opts)
+}
+
+// defaultResizer is what the package level functions use
+var defaultResizer = New()
@@ -0,0 +1,130 @@
+package resize
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+	"testing/quick"
+
+	"golang.org/x/image/draw"
+)
+
+func Test_Resizer(t *testing.T) {
+	src := testPatternImage(97, 61)
+	specs := []string{"full", "10s", "20w", "15h", "200w", "crop:10,10,30,20-full"}
+
+	plain := New()
+	parallel := New(WithWorkers(3))
+	catmull := New(WithFilter(draw.CatmullRom))
+	for _, s := range specs {
+		want := Resize(src, s)
+		for name, r := range map[string]*Resizer{"default": plain, "parallel": parallel} {
+			got, err := r.Resize(src, s)
+			if err != nil {
+				t.Fatal(name, s, err)
+			}
+			if !sameImage(got, want) {
+				t.Error(name, s, "-- differs from Resize")
+			}
+			got, err = r.ResizeSpec(src, MakeSizeSpec(s))
+			if err != nil || !sameImage(got, want) {
+				t.Error(name, s, "-- ResizeSpec differs from Resize", err)
+			}
+		}
+		got, err := catmull.Resize(src, s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if !sameImage(got, ResizeFilter(src, s, draw.CatmullRom)) {
+			t.Error(s, "-- filter option differs from ResizeFilter")
+		}
+	}
+	if _, err := plain.Resize(src, "nonsense"); err != ErrInvalidSpec {
+		t.Error("expected ErrInvalidSpec, got", err)
+	}
+
+	limited := New(WithLimits(Limits{MaxOutputPixels: 100}), WithMaxPixels(5000))
+	if _, err := limited.Resize(src, "10s"); !errors.Is(err, ErrLimitExceeded) {
+		t.Error("expected the source pixels limit, got", err)
+	}
+	small := testPatternImage(50, 50)
+	if _, err := limited.Resize(small, "10s"); err != nil {
+		t.Error(err)
+	}
+	var le *LimitError
+	if _, err := limited.Resize(small, "11s"); !errors.As(err, &le) || le.Limit != "output pixels" {
+		t.Error("WithMaxPixels should keep the other limits, got", err)
+	}
+}
+
+func Test_WithoutUpscaling(t *testing.T) {
+	src := testPatternImage(40, 20)
+	r := New(WithoutUpscaling())
+	for _, c := range []struct {
+		spec string
+		w, h int
+	}{
+		{"100w", 40, 20},
+		{"10w", 10, 5},
+		{"100s", 20, 20},
+		{"100h", 40, 20},
+		{"100w50h", 40, 20},
+		{"100w25h", 40, 10},
+		{"crop:0,0,10,10-50s", 10, 10},
+		{"full", 40, 20},
+	} {
+		plan := r.Plan(src.Bounds(), c.spec)
+		if plan.Width != c.w || plan.Height != c.h || plan.Upscale {
+			t.Error(c.spec, "-- expected", c.w, c.h, "got", plan.Width, plan.Height, plan.Upscale)
+		}
+		m, err := r.Resize(src, c.spec)
+		if err != nil {
+			t.Fatal(c.spec, err)
+		}
+		if m.Bounds() != image.Rect(0, 0, c.w, c.h) {
+			t.Error(c.spec, "-- resized to", m.Bounds())
+		}
+	}
+
+	// the output never gets bigger than the crop, and keeps its
+	// aspect ratio to within a pixel
+	f := func(sw, sh, tw, th uint16) bool {
+		plan := ResizePlan{
+			Crop:    image.Rect(0, 0, 1+int(sw)%3000, 1+int(sh)%3000),
+			Width:   1 + int(tw)%5000,
+			Height:  1 + int(th)%5000,
+			Upscale: true,
+		}
+		p := plan.withoutUpscale()
+		if p.Width > plan.Crop.Dx() || p.Height > plan.Crop.Dy() {
+			return false
+		}
+		if p.Width != plan.Crop.Dx() && p.Height != plan.Crop.Dy() {
+			return false
+		}
+		d := int64(p.Width)*int64(plan.Height) - int64(p.Height)*int64(plan.Width)
+		return abs64(d) <= int64(plan.Width+plan.Height)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_ResizerStream(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+	r := New(WithFormat("png"), WithoutUpscaling())
+	var out bytes.Buffer
+	res, err := r.ResizeStream(&out, bytes.NewReader(jpg), "100w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal("output isn't a PNG", err)
+	}
+	if res.Format != "png" || m.Bounds() != image.Rect(0, 0, 40, 20) {
+		t.Error("bad result", res, m.Bounds())
+	}
+}
@@ -0,0 +1,110 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"context"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Box is the box filter that Resize uses, as a golang.org/x/image/draw
+// Scaler. Every source pixel contributes to the destination pixels it
+// overlaps, in proportion to the overlap, so it's good for shrinking and
+// acts like nearest neighbour when enlarging.
+var Box draw.Scaler = boxScaler{}
+
+// Nearest is the nearest neighbour sampling that Resample uses, as a
+// golang.org/x/image/draw Scaler.
+var Nearest draw.Scaler = nearestScaler{}
+
+// both scalers support the Over and Src ops and opts.DstMask.
+// opts.SrcMask is ignored.
+
+type boxScaler struct{}
+
+// Scale scales the sr part of src to the dr part of dst.
+func (boxScaler) Scale(dst draw.Image, dr image.Rectangle, src image.Image, sr image.Rectangle, op draw.Op, opts *draw.Options) {
+	scaleVia(dst, dr, src, sr, op, opts, func(out draw.Image, sr image.Rectangle) {
+		plan := ResizePlan{Source: src.Bounds(), Crop: sr, Width: dr.Dx(), Height: dr.Dy()}
+		resizeInto(context.Background(), out, src, plan, 1)
+	})
+}
+
+type nearestScaler struct{}
+
+// Scale scales the sr part of src to the dr part of dst.
+func (nearestScaler) Scale(dst draw.Image, dr image.Rectangle, src image.Image, sr image.Rectangle, op draw.Op, opts *draw.Options) {
+	scaleVia(dst, dr, src, sr, op, opts, func(out draw.Image, sr image.Rectangle) {
+		b := out.Bounds()
+		w, h := dr.Dx(), dr.Dy()
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				out.Set(b.Min.X+x, b.Min.Y+y, src.At(sr.Min.X+x*sr.Dx()/w, sr.Min.Y+y*sr.Dy()/h))
+			}
+		}
+	})
+}
+
+// scaleVia does the clipping and compositing for the scalers. scale
+// has to fill out (which is the size of dr) from the sr part of src.
+// if it can, it scales straight into dst, otherwise into a temporary
+// image that's then drawn onto dst.
+func scaleVia(dst draw.Image, dr image.Rectangle, src image.Image, sr image.Rectangle, op draw.Op, opts *draw.Options, scale func(out draw.Image, sr image.Rectangle)) {
+	sr = sr.Intersect(src.Bounds())
+	if dr.Empty() || sr.Empty() || !dr.Overlaps(dst.Bounds()) {
+		return
+	}
+	var mask image.Image
+	var maskP image.Point
+	if opts != nil {
+		mask, maskP = opts.DstMask, opts.DstMaskP
+	}
+	if rgba, ok := dst.(*image.RGBA); ok && op == draw.Src && mask == nil && dr.In(rgba.Bounds()) {
+		scale(rgba.SubImage(dr).(*image.RGBA), sr)
+		return
+	}
+	tmp := image.NewRGBA(dr)
+	scale(tmp, sr)
+	clip := dr.Intersect(dst.Bounds())
+	if mask != nil {
+		draw.DrawMask(dst, clip, tmp, clip.Min, mask, maskP.Add(clip.Min.Sub(dr.Min)), op)
+		return
+	}
+	draw.Draw(dst, clip, tmp, clip.Min, op)
+}
+
+// ResizeFilter is like Resize, but scales with filter, which can be
+// any golang.org/x/image/draw Scaler or Interpolator (eg,
+// draw.CatmullRom), instead of the box filter. The crop and size are
+// worked out from sizeStr exactly as they are for Resize.
+func ResizeFilter(m image.Image, sizeStr string, filter draw.Scaler) image.Image {
+	ss := MakeSizeSpec(sizeStr)
+	return scalePlan(m, ss.PlanImage(m), filter)
+}
+
+// scalePlan carries out plan on m using filter
+func scalePlan(m image.Image, plan ResizePlan, filter draw.Scaler) image.Image {
+	r := plan.Crop
+	w, h := plan.Width, plan.Height
+	if w < 0 || h < 0 {
+		return nil
+	}
+	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
+		return image.NewRGBA64(r.Sub(r.Min))
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	if plan.Orientation.transforms() {
+		sw, sh := plan.scaledSize()
+		tmp := image.NewRGBA(image.Rect(0, 0, sw, sh))
+		filter.Scale(tmp, tmp.Bounds(), m, r, draw.Src, nil)
+		orientInto(out, tmp, plan.Orientation)
+	} else {
+		filter.Scale(out, out.Bounds(), m, r, draw.Src, nil)
+	}
+	sharpenRGBA(out, plan.Sharpen)
+	flattenRGBA(out, plan.Background)
+	return out
+}
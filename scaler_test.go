@@ -0,0 +1,119 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func Test_Scalers(t *testing.T) {
+	src := testPatternImage(97, 61)
+	sr := image.Rect(5, 3, 90, 58)
+	for _, size := range []image.Point{{10, 7}, {40, 40}, {85, 55}, {200, 90}} {
+		dr := image.Rectangle{Max: size}
+		for _, c := range []struct {
+			name   string
+			scaler draw.Scaler
+			want   image.Image
+		}{
+			{"box", Box, resizePlan(src, ResizePlan{Source: src.Bounds(), Crop: sr, Width: size.X, Height: size.Y})},
+			{"nearest", Nearest, Resample(src, sr, size.X, size.Y)},
+		} {
+			// straight into an RGBA
+			dst := image.NewRGBA(dr)
+			c.scaler.Scale(dst, dr, src, sr, draw.Src, nil)
+			if !sameImage(dst, c.want) {
+				t.Error(c.name, size, "-- differs from the package's own resize")
+			}
+
+			// into the middle of something else, which should only
+			// change the pixels in dr
+			big := image.NewNRGBA(image.Rect(-10, -10, size.X+20, size.Y+20))
+			draw.Draw(big, big.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+			moved := dr.Add(image.Pt(3, 4))
+			c.scaler.Scale(big, moved, src, sr, draw.Src, nil)
+			for y := big.Bounds().Min.Y; y < big.Bounds().Max.Y; y++ {
+				for x := big.Bounds().Min.X; x < big.Bounds().Max.X; x++ {
+					got := color.RGBAModel.Convert(big.At(x, y))
+					want := color.Color(color.RGBA{255, 0, 0, 255})
+					if image.Pt(x, y).In(moved) {
+						want = c.want.At(x-moved.Min.X, y-moved.Min.Y)
+						// NRGBA loses a little on the way through
+						if !closeColor(got, want) {
+							t.Fatal(c.name, size, "-- wrong pixel inside dr at", x, y, got, want)
+						}
+					} else if got != want {
+						t.Fatal(c.name, size, "-- pixel outside dr changed at", x, y)
+					}
+				}
+			}
+
+			// over an opaque background
+			bg := color.RGBA{0, 0, 255, 255}
+			dst = image.NewRGBA(dr)
+			draw.Draw(dst, dr, image.NewUniform(bg), image.Point{}, draw.Src)
+			c.scaler.Scale(dst, dr, src, sr, draw.Over, nil)
+			want := image.NewRGBA(dr)
+			draw.Draw(want, dr, image.NewUniform(bg), image.Point{}, draw.Src)
+			draw.Draw(want, dr, c.want, image.Point{}, draw.Over)
+			if !sameImage(dst, want) {
+				t.Error(c.name, size, "-- Over isn't the same as drawing the result over")
+			}
+
+			// hanging off the edge of dst
+			dst = image.NewRGBA(image.Rect(0, 0, size.X/2, size.Y/2))
+			c.scaler.Scale(dst, dr, src, sr, draw.Src, nil)
+			if !sameImage(dst, c.want.(*image.RGBA).SubImage(dst.Bounds())) {
+				t.Error(c.name, size, "-- clipped scale doesn't match")
+			}
+
+			// with a mask covering the left half
+			dst = image.NewRGBA(dr)
+			mask := image.NewAlpha(dr)
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X/2; x++ {
+					mask.SetAlpha(x, y, color.Alpha{255})
+				}
+			}
+			c.scaler.Scale(dst, dr, src, sr, draw.Src, &draw.Options{DstMask: mask})
+			left := image.Rect(0, 0, size.X/2, size.Y)
+			if !sameImage(dst.SubImage(left), c.want.(*image.RGBA).SubImage(left)) {
+				t.Error(c.name, size, "-- masked part doesn't match")
+			}
+			if !sameImage(dst.SubImage(image.Rect(size.X/2, 0, size.X, size.Y)), image.NewRGBA(image.Rect(size.X/2, 0, size.X, size.Y))) {
+				t.Error(c.name, size, "-- outside the mask should be left alone")
+			}
+		}
+	}
+}
+
+func closeColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	for _, d := range []int64{int64(r1) - int64(r2), int64(g1) - int64(g2), int64(b1) - int64(b2), int64(a1) - int64(a2)} {
+		if abs64(d) > 0x200 {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_ResizeFilter(t *testing.T) {
+	src := testPatternImage(97, 61)
+	for _, s := range []string{"10s", "20w", "15h", "200w", "crop:10,10,30,20-full"} {
+		want := Resize(src, s)
+		if !sameImage(ResizeFilter(src, s, Box), want) {
+			t.Error(s, "-- ResizeFilter with Box should be the same as Resize")
+		}
+		for _, filter := range []draw.Scaler{draw.CatmullRom, draw.ApproxBiLinear, Nearest} {
+			if got := ResizeFilter(src, s, filter); got.Bounds() != want.Bounds() {
+				t.Errorf("%s %T -- wrong size %v, expected %v", s, filter, got.Bounds(), want.Bounds())
+			}
+		}
+	}
+	if ResizeFilter(src, "nonsense", draw.CatmullRom) != nil {
+		t.Error("expected nil for an invalid spec")
+	}
+}
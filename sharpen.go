@@ -0,0 +1,261 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SharpenOptions describe an unsharp mask, which box filtered
+// thumbnails usually benefit from. A zero Amount or Radius is worked
+// out from how much the image was scaled down (more for bigger
+// reductions), so the zero value is a sensible default.
+type SharpenOptions struct {
+	// Amount is how much of the difference between the image and
+	// its blurred copy is added back, eg, 0.5 for 50%.
+	Amount float64
+	// Radius is the standard deviation of the Gaussian blur, in
+	// pixels of the output. Anything over 10 is treated as 10.
+	Radius float64
+	// Threshold is the smallest difference (0-255) from the blurred
+	// copy that gets sharpened, so smooth areas and noise can be left
+	// alone. Zero sharpens everything.
+	Threshold int
+}
+
+// the largest Radius and Amount a "sharp" spec component can ask for.
+// specs usually come from URLs, and a big enough radius would use up
+// all the memory there is.
+const (
+	maxSharpenRadius = 10
+	maxSharpenAmount = 10
+)
+
+// parseSharpen parses the part of a "sharp" spec component after the
+// colon: "amount", "amount,radius" or "amount,radius,threshold"
+func parseSharpen(str string) (*SharpenOptions, bool) {
+	s := &SharpenOptions{}
+	if str == "" {
+		return s, true
+	}
+	fields := strings.Split(str, ",")
+	if len(fields) > 3 {
+		return nil, false
+	}
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(f, 64)
+		if err != nil || x < 0 || math.IsInf(x, 0) || math.IsNaN(x) {
+			return nil, false
+		}
+		switch i {
+		case 0:
+			if x > maxSharpenAmount {
+				return nil, false
+			}
+			s.Amount = x
+		case 1:
+			if x > maxSharpenRadius {
+				return nil, false
+			}
+			s.Radius = x
+		case 2:
+			if x != math.Trunc(x) || x > 255 {
+				return nil, false
+			}
+			s.Threshold = int(x)
+		}
+	}
+	return s, true
+}
+
+func (self *SharpenOptions) String() string {
+	if *self == (SharpenOptions{}) {
+		return "sharp"
+	}
+	f := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+	str := "sharp:" + f(self.Amount)
+	if self.Radius != 0 || self.Threshold != 0 {
+		str += "," + f(self.Radius)
+	}
+	if self.Threshold != 0 {
+		str += "," + strconv.Itoa(self.Threshold)
+	}
+	return str
+}
+
+// resolve fills in the adaptive parts of the options for a resize by
+// scaleX, scaleY. it returns nil if there's nothing to do, eg, for an
+// adaptive sharpen on an image that wasn't made smaller.
+func (self *SharpenOptions) resolve(scaleX, scaleY float64) *SharpenOptions {
+	if self == nil {
+		return nil
+	}
+	s := *self
+	// how much the image was reduced, going by the axis that was
+	// reduced least
+	reduction := 1.0
+	if scale := math.Max(scaleX, scaleY); scale > 0 {
+		reduction = 1 / scale
+	}
+	steps := math.Log2(math.Max(reduction, 1))
+	if s.Amount == 0 {
+		s.Amount = math.Min(0.25*steps, 0.8)
+		if s.Amount < 0.05 {
+			return nil
+		}
+	}
+	if s.Radius == 0 {
+		s.Radius = math.Min(0.5+0.1*steps, 1)
+	}
+	return &s
+}
+
+// Sharpen returns a copy of m with an unsharp mask applied. Zero
+// Amount and Radius are treated as for a 2:1 reduction. *image.RGBA and
+// *image.YCbCr (where only the brightness is sharpened, which avoids
+// coloured fringes) are handled directly, anything else is converted
+// to RGBA first.
+func Sharpen(m image.Image, opts SharpenOptions) image.Image {
+	s := opts.resolve(0.5, 0.5)
+	switch m := m.(type) {
+	case *image.YCbCr:
+		out := *m
+		out.Y = append([]uint8{}, m.Y...)
+		out.Cb = append([]uint8{}, m.Cb...)
+		out.Cr = append([]uint8{}, m.Cr...)
+		if s != nil {
+			unsharpPlane(out.Y[out.YOffset(m.Rect.Min.X, m.Rect.Min.Y):], out.YStride, m.Rect.Dx(), m.Rect.Dy(), 1, 1, s)
+		}
+		return &out
+	}
+	b := m.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, m, b.Min, draw.Src)
+	sharpenRGBA(out, s)
+	return out
+}
+
+// sharpenRGBA sharpens m in place. the colour channels are sharpened,
+// then kept within alpha so they're still valid premultiplied values.
+func sharpenRGBA(m *image.RGBA, s *SharpenOptions) {
+	if s == nil || m.Rect.Empty() {
+		return
+	}
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	pix := m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):]
+	unsharpPlane(pix, m.Stride, w, h, 4, 3, s)
+	for y := 0; y < h; y++ {
+		row := pix[y*m.Stride : y*m.Stride+4*w]
+		for i := 0; i < len(row); i += 4 {
+			a := row[i+3]
+			for c := 0; c < 3; c++ {
+				if row[i+c] > a {
+					row[i+c] = a
+				}
+			}
+		}
+	}
+}
+
+// sharpenInto sharpens dst in place, whatever kind of image it is
+func sharpenInto(dst draw.Image, s *SharpenOptions) {
+	if s == nil {
+		return
+	}
+	if rgba, ok := dst.(*image.RGBA); ok {
+		sharpenRGBA(rgba, s)
+		return
+	}
+	b := dst.Bounds()
+	tmp := image.NewRGBA(b)
+	draw.Draw(tmp, b, dst, b.Min, draw.Src)
+	sharpenRGBA(tmp, s)
+	draw.Draw(dst, b, tmp, b.Min, draw.Src)
+}
+
+// gaussianKernel returns half of a normalized Gaussian kernel, from
+// the centre out, reaching three standard deviations. sigma is kept
+// to a sane range, as SharpenOptions can come from anywhere.
+func gaussianKernel(sigma float64) []float32 {
+	if !(sigma <= maxSharpenRadius) {
+		// NaN ends up here too
+		sigma = maxSharpenRadius
+	}
+	if sigma < 0.01 {
+		sigma = 0.01
+	}
+	n := int(math.Ceil(3 * sigma))
+	if n < 1 {
+		n = 1
+	}
+	k := make([]float64, n+1)
+	total := 0.0
+	for i := range k {
+		k[i] = math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		total += k[i]
+		if i > 0 {
+			total += k[i]
+		}
+	}
+	out := make([]float32, n+1)
+	for i := range k {
+		out[i] = float32(k[i] / total)
+	}
+	return out
+}
+
+// unsharpPlane sharpens the first channels of each step bytes of a
+// w * h plane in place. the blur is separable: rows first into a float
+// buffer, then columns. pixels past the edges repeat the edge.
+func unsharpPlane(pix []uint8, stride, w, h, step, channels int, s *SharpenOptions) {
+	kernel := gaussianKernel(s.Radius)
+	n := len(kernel) - 1
+	amount := float32(s.Amount)
+	threshold := float32(s.Threshold)
+	clampTo := func(i, max int) int {
+		if i < 0 {
+			return 0
+		}
+		if i >= max {
+			return max - 1
+		}
+		return i
+	}
+	rows := make([]float32, w*h)
+	blurred := make([]float32, h)
+	for c := 0; c < channels; c++ {
+		for y := 0; y < h; y++ {
+			row := pix[y*stride:]
+			for x := 0; x < w; x++ {
+				v := kernel[0] * float32(row[x*step+c])
+				for i := 1; i <= n; i++ {
+					v += kernel[i] * (float32(row[clampTo(x-i, w)*step+c]) + float32(row[clampTo(x+i, w)*step+c]))
+				}
+				rows[y*w+x] = v
+			}
+		}
+		for x := 0; x < w; x++ {
+			for y := 0; y < h; y++ {
+				v := kernel[0] * rows[y*w+x]
+				for i := 1; i <= n; i++ {
+					v += kernel[i] * (rows[clampTo(y-i, h)*w+x] + rows[clampTo(y+i, h)*w+x])
+				}
+				blurred[y] = v
+			}
+			for y := 0; y < h; y++ {
+				p := &pix[y*stride+x*step+c]
+				orig := float32(*p)
+				diff := orig - blurred[y]
+				if diff < threshold && -diff < threshold {
+					continue
+				}
+				*p = clampPixel(orig + amount*diff)
+			}
+		}
+	}
+}
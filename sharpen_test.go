@@ -0,0 +1,213 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+type sharpSpecTestCase struct {
+	Spec      string
+	Canonical string
+}
+
+func Test_SharpSpec(t *testing.T) {
+	cases := []sharpSpecTestCase{
+		{"100s-sharp", "100s-sharp"},
+		{"sharp-100s", "100s-sharp"},
+		{"sharp:0.5,1,3-200w", "200w-sharp:0.5,1,3"},
+		{"200w/sharp:0.5", "200w-sharp:0.5"},
+		{"200w-sharp:0.5,0", "200w-sharp:0.5"},
+		{"200w-sharp:0,0,4", "200w-sharp:0,0,4"},
+		{"crop:0,0,10,10-50h-sharp", "crop:0,0,10,10-50h-sharp"},
+		{"sharp", "full-sharp"},
+		// invalid sharpening is ignored
+		{"200w-sharp:x", "200w"},
+		{"200w-sharp:1,x", "200w"},
+		{"200w-sharp:1,1,1,1", "200w"},
+		{"200w-sharp:1,1,0.5", "200w"},
+		{"200w-sharp:1,1,256", "200w"},
+		{"200w-sharp:NaN", "200w"},
+		{"200w-sharp:0.5,NaN", "200w"},
+		{"100s-sharp:0.5,1e9", "100s"},
+		{"100s-sharp:11", "100s"},
+		{"100s-sharp:10,10", "100s-sharp:10,10"},
+	}
+	for _, c := range cases {
+		got := MakeSizeSpec(c.Spec).Canonical()
+		if got != c.Canonical {
+			t.Errorf("%s -- got %q, expected %q", c.Spec, got, c.Canonical)
+		}
+		if again := MakeSizeSpec(got).Canonical(); again != got {
+			t.Errorf("%s -- canonical form %q isn't stable, got %q", c.Spec, got, again)
+		}
+	}
+}
+
+func Test_SharpenResolve(t *testing.T) {
+	src := image.Rect(0, 0, 1600, 1200)
+	if p := MakeSizeSpec("1600w-sharp").Plan(src); p.Sharpen != nil || !p.NoOp {
+		t.Error("adaptive sharpening at the same size should do nothing", p.Sharpen)
+	}
+	if p := MakeSizeSpec("3200w-sharp").Plan(src); p.Sharpen != nil {
+		t.Error("adaptive sharpening shouldn't sharpen an enlargement", p.Sharpen)
+	}
+	if p := MakeSizeSpec("1600w-sharp:0.5").Plan(src); p.Sharpen == nil || p.NoOp {
+		t.Error("an explicit amount should always sharpen")
+	}
+	last := SharpenOptions{}
+	for _, spec := range []string{"800w-sharp", "400w-sharp", "200w-sharp", "50w-sharp"} {
+		s := MakeSizeSpec(spec).Plan(src).Sharpen
+		if s == nil {
+			t.Fatal(spec, "wasn't sharpened")
+		}
+		if s.Amount < last.Amount || s.Radius < last.Radius {
+			t.Error(spec, "sharpens less than a smaller reduction", *s, last)
+		}
+		if s.Amount > 0.8 || s.Radius > 1 {
+			t.Error(spec, "sharpens too much", *s)
+		}
+		last = *s
+	}
+	adaptive := MakeSizeSpec("200w-sharp").Plan(src).Sharpen
+	s := MakeSizeSpec("200w-sharp:0,2,3").Plan(src).Sharpen
+	if s.Amount != adaptive.Amount || s.Radius != 2 || s.Threshold != 3 {
+		t.Error("explicit settings should be kept", *s)
+	}
+
+	// sharpening set in options is used when the spec doesn't say
+	opts := &Options{Sharpen: &SharpenOptions{Amount: 0.3}}
+	if p := opts.plan(MakeSizeSpec("200w"), src); p.Sharpen == nil || p.Sharpen.Amount != 0.3 {
+		t.Error("options sharpening wasn't used", p.Sharpen)
+	}
+	if p := opts.plan(MakeSizeSpec("200w-sharp:0.6"), src); p.Sharpen.Amount != 0.6 {
+		t.Error("the spec should win", p.Sharpen)
+	}
+}
+
+// stepEdge is a w x h image, dark on the left half and light on the right
+func stepEdge(w, h int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(64)
+			if x >= w/2 {
+				v = 192
+			}
+			m.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return m
+}
+
+func Test_SharpenEdge(t *testing.T) {
+	m := stepEdge(20, 5)
+	got := Sharpen(m, SharpenOptions{Amount: 1, Radius: 1}).(*image.RGBA)
+	for y := 0; y < 5; y++ {
+		dark, light := got.RGBAAt(9, y), got.RGBAAt(10, y)
+		if dark.R >= 64 || light.R <= 192 {
+			t.Error("edge wasn't sharpened", dark, light)
+		}
+		if dark.A != 255 || light.A != 255 {
+			t.Error("alpha shouldn't change", dark, light)
+		}
+		// far from the edge nothing changes
+		if got.RGBAAt(0, y) != m.RGBAAt(0, y) || got.RGBAAt(19, y) != m.RGBAAt(19, y) {
+			t.Error("flat areas changed", got.RGBAAt(0, y), got.RGBAAt(19, y))
+		}
+	}
+	if m.RGBAAt(9, 0).R != 64 {
+		t.Error("Sharpen changed its input")
+	}
+	// silly radiuses don't run out of memory
+	for _, r := range []float64{1e9, math.NaN(), -1} {
+		if k := gaussianKernel(r); len(k) > 3*maxSharpenRadius+1 {
+			t.Error(r, "-- kernel too big", len(k))
+		}
+		Sharpen(m, SharpenOptions{Amount: 1, Radius: r})
+	}
+
+	// a threshold above the difference leaves it alone
+	same := Sharpen(m, SharpenOptions{Amount: 1, Radius: 1, Threshold: 100}).(*image.RGBA)
+	for i := range m.Pix {
+		if same.Pix[i] != m.Pix[i] {
+			t.Fatal("differences under the threshold were sharpened")
+		}
+	}
+}
+
+func Test_SharpenPremultiplied(t *testing.T) {
+	// a half transparent white square on a transparent background.
+	// sharpening mustn't make the colour more than the alpha.
+	m := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 3; y < 7; y++ {
+		for x := 3; x < 7; x++ {
+			m.SetRGBA(x, y, color.RGBA{128, 128, 128, 128})
+		}
+	}
+	got := Sharpen(m, SharpenOptions{Amount: 2, Radius: 1}).(*image.RGBA)
+	for i := 0; i < len(got.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			if got.Pix[i+c] > got.Pix[i+3] {
+				t.Fatal("colour over alpha", got.Pix[i:i+4])
+			}
+		}
+	}
+}
+
+func Test_SharpenYCbCr(t *testing.T) {
+	m := image.NewYCbCr(image.Rect(0, 0, 20, 10), image.YCbCrSubsampleRatio420)
+	for i := range m.Y {
+		m.Y[i] = 64
+		if i%m.YStride >= 10 {
+			m.Y[i] = 192
+		}
+	}
+	for i := range m.Cb {
+		m.Cb[i], m.Cr[i] = 100, 150
+	}
+	got, ok := Sharpen(m, SharpenOptions{Amount: 1, Radius: 1}).(*image.YCbCr)
+	if !ok {
+		t.Fatal("YCbCr should stay YCbCr")
+	}
+	if got.Y[9] >= 64 || got.Y[10] <= 192 {
+		t.Error("brightness wasn't sharpened", got.Y[9], got.Y[10])
+	}
+	for i := range got.Cb {
+		if got.Cb[i] != 100 || got.Cr[i] != 150 {
+			t.Fatal("colour changed")
+		}
+	}
+	if m.Y[9] != 64 {
+		t.Error("Sharpen changed its input")
+	}
+}
+
+func Test_ResizeSharp(t *testing.T) {
+	m := stepEdge(400, 40)
+	plain := Resize(m, "100w").(*image.RGBA)
+	sharp := Resize(m, "100w-sharp").(*image.RGBA)
+	if sharp.Bounds() != plain.Bounds() {
+		t.Fatal("sharpening changed the size", sharp.Bounds(), plain.Bounds())
+	}
+	if sharp.RGBAAt(49, 5).R >= plain.RGBAAt(49, 5).R {
+		t.Error("resize wasn't sharpened", sharp.RGBAAt(49, 5), plain.RGBAAt(49, 5))
+	}
+
+	// every way of resizing sharpens the same
+	dst := image.NewRGBA(plain.Bounds())
+	if err := ResizeInto(dst, m, MakeSizeSpec("100w-sharp")); err != nil {
+		t.Fatal(err)
+	}
+	r := New(WithSharpen(SharpenOptions{}))
+	viaOpts, err := r.Resize(m, "100w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sharp.Pix {
+		if dst.Pix[i] != sharp.Pix[i] || viaOpts.(*image.RGBA).Pix[i] != sharp.Pix[i] {
+			t.Fatal("ResizeInto or WithSharpen differ from Resize with sharp")
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SrcsetEntry is one size of an image in a srcset.
+type SrcsetEntry struct {
+	// Spec makes this size. Spec.String() is its canonical form, for
+	// building URLs.
+	Spec *SizeSpec
+	// Width and Height are exactly what the spec will produce for
+	// the source.
+	Width  int
+	Height int
+	// Descriptor is the srcset descriptor, eg, "400w" or "2x".
+	Descriptor string
+}
+
+// Srcset returns the specs that make the image that the spec makes, at
+// each of widths, for a source with bounds src. The crop and aspect
+// ratio stay the same, only the size changes. Widths that would mean
+// enlarging the source (or its crop) are left out, as are ones that
+// come out the same as a narrower one. The entries are in order of
+// width, with "w" descriptors.
+func (self SizeSpec) Srcset(src image.Rectangle, widths []int) []SrcsetEntry {
+	base := self.Plan(src)
+	if base.Width <= 0 || base.Height <= 0 {
+		return nil
+	}
+	widths = append([]int{}, widths...)
+	sort.Ints(widths)
+	var entries []SrcsetEntry
+	for _, w := range widths {
+		if w <= 0 {
+			continue
+		}
+		ss := self.scaled(float64(w)/float64(base.Width), base)
+		plan := ss.Plan(src)
+		if plan.Upscale || plan.Width <= 0 {
+			continue
+		}
+		if n := len(entries); n > 0 && entries[n-1].Width == plan.Width {
+			continue
+		}
+		entries = append(entries, SrcsetEntry{ss, plan.Width, plan.Height, strconv.Itoa(plan.Width) + "w"})
+	}
+	return entries
+}
+
+// DensitySrcset is like Srcset, but for a fixed size image on screens
+// with different pixel densities, eg, 1, 1.5 and 2. The entries have
+// "x" descriptors, and the 1x entry is the spec itself.
+func (self SizeSpec) DensitySrcset(src image.Rectangle, densities []float64) []SrcsetEntry {
+	base := self.Plan(src)
+	if base.Width <= 0 || base.Height <= 0 {
+		return nil
+	}
+	densities = append([]float64{}, densities...)
+	sort.Float64s(densities)
+	var entries []SrcsetEntry
+	for _, d := range densities {
+		if d <= 0 {
+			continue
+		}
+		ss := self.scaled(d, base)
+		plan := ss.Plan(src)
+		if plan.Upscale || plan.Width <= 0 {
+			continue
+		}
+		if n := len(entries); n > 0 && entries[n-1].Width == plan.Width {
+			continue
+		}
+		desc := strconv.FormatFloat(d, 'f', -1, 64) + "x"
+		entries = append(entries, SrcsetEntry{ss, plan.Width, plan.Height, desc})
+	}
+	return entries
+}
+
+// scaled returns a copy of the spec with its size multiplied by k.
+// base is the spec's plan for the source, which is needed for "full".
+func (self SizeSpec) scaled(k float64, base ResizePlan) *SizeSpec {
+	scale := func(n int) int {
+		return int(math.Max(1, math.Round(float64(n)*k)))
+	}
+	if self.full {
+		self.full = false
+		self.width = scale(base.Width)
+		self.height = -1
+		return &self
+	}
+	if self.width > 0 {
+		self.width = scale(self.width)
+	}
+	if self.height > 0 {
+		self.height = scale(self.height)
+	}
+	return &self
+}
+
+// SrcsetAttr renders entries as the value of an HTML srcset attribute.
+// url returns the URL of the image for an entry. The result isn't
+// escaped for HTML.
+func SrcsetAttr(entries []SrcsetEntry, url func(SrcsetEntry) string) string {
+	parts := make([]string, len(entries))
+	for i, e := range entries {
+		parts[i] = url(e) + " " + e.Descriptor
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SizesRule is one entry of an HTML sizes attribute: the image is
+// displayed Length wide when Media matches.
+type SizesRule struct {
+	Media  string
+	Length string
+}
+
+// SizesAttr renders the value of an HTML sizes attribute. fallback is
+// the length when none of the rules match. The result isn't escaped for
+// HTML.
+//
+//	SizesAttr([]SizesRule{{"(max-width: 600px)", "100vw"}}, "600px")
+//	// (max-width: 600px) 100vw, 600px
+func SizesAttr(rules []SizesRule, fallback string) string {
+	var parts []string
+	for _, r := range rules {
+		parts = append(parts, r.Media+" "+r.Length)
+	}
+	if fallback != "" {
+		parts = append(parts, fallback)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// PictureOptions control the markup from PictureHTML.
+type PictureOptions struct {
+	// Formats are the MIME types to offer, in order of preference,
+	// eg, "image/avif", "image/webp", "image/jpeg". The last one is
+	// used for the <img>, so it should be something every browser
+	// can show. With none, there's just the <img>.
+	Formats []string
+	// URL returns the URL of an entry in a format.
+	URL func(e SrcsetEntry, format string) string
+	// Sizes is the sizes attribute, if there is one. See SizesAttr.
+	Sizes string
+	// Alt is the alt text for the <img>.
+	Alt string
+}
+
+// PictureHTML renders a <picture> element, with a <source> for each
+// format and an <img> for the last one. The <img> gets the smallest
+// entry as its src and width and height attributes, so the browser can
+// lay the page out before the image arrives. Everything is escaped.
+func PictureHTML(entries []SrcsetEntry, opts PictureOptions) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	formats := opts.Formats
+	if len(formats) == 0 {
+		formats = []string{""}
+	}
+	attr := func(name, value string) string {
+		return " " + name + `="` + html.EscapeString(value) + `"`
+	}
+	srcset := func(format string) string {
+		return SrcsetAttr(entries, func(e SrcsetEntry) string { return opts.URL(e, format) })
+	}
+	sizes := ""
+	if opts.Sizes != "" {
+		sizes = attr("sizes", opts.Sizes)
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	for _, f := range formats[:len(formats)-1] {
+		fmt.Fprintf(&b, "  <source%s%s%s>\n", attr("type", f), attr("srcset", srcset(f)), sizes)
+	}
+	last := formats[len(formats)-1]
+	first := entries[0]
+	fmt.Fprintf(&b, "  <img%s%s%s%s%s%s>\n",
+		attr("src", opts.URL(first, last)), attr("srcset", srcset(last)), sizes,
+		attr("width", strconv.Itoa(first.Width)), attr("height", strconv.Itoa(first.Height)),
+		attr("alt", opts.Alt))
+	b.WriteString("</picture>")
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package resize
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type srcsetTestCase struct {
+	Spec     string
+	Expected []string
+}
+
+func Test_Srcset(t *testing.T) {
+	src := image.Rect(0, 0, 1000, 750)
+	widths := []int{1600, 200, 400, 800}
+	cases := []srcsetTestCase{
+		{"100w", []string{"200w 200x150", "400w 400x300", "800w 800x600"}},
+		{"100s", []string{"200s 200x200", "400s 400x400"}},
+		{"300h", []string{"150h 200x150", "300h 400x300", "600h 800x600"}},
+		{"full", []string{"200w 200x150", "400w 400x300", "800w 800x600"}},
+		{"400w100h", []string{"200w50h 200x50", "400w100h 400x100", "800w200h 800x200"}},
+		// boxes never upscale, so the biggest is the whole source
+		{"500w500h", []string{"200w200h 200x150", "400w400h 400x300", "800w800h 800x600", "1600w1600h 1000x750"}},
+		{"crop:0,0,500,500-100s", []string{"crop:0,0,500,500-200s 200x200", "crop:0,0,500,500-400s 400x400"}},
+		{"nonsense", nil},
+	}
+	for _, c := range cases {
+		got := MakeSizeSpec(c.Spec).Srcset(src, widths)
+		var gotStrings []string
+		for _, e := range got {
+			gotStrings = append(gotStrings, fmt.Sprintf("%s %dx%d", e.Spec, e.Width, e.Height))
+			if e.Descriptor != strconv.Itoa(e.Width)+"w" {
+				t.Error(c.Spec, "-- bad descriptor", e.Descriptor, "for", e.Width)
+			}
+			// the sizes are what Resize will make
+			if w, h := e.Spec.TargetWH(src); w != e.Width || h != e.Height {
+				t.Error(c.Spec, "-- entry", e.Spec, "says", e.Width, e.Height, "but makes", w, h)
+			}
+		}
+		if strings.Join(gotStrings, ", ") != strings.Join(c.Expected, ", ") {
+			t.Errorf("%s -- got %v, expected %v", c.Spec, gotStrings, c.Expected)
+		}
+	}
+}
+
+func Test_DensitySrcset(t *testing.T) {
+	src := image.Rect(0, 0, 1000, 750)
+	got := MakeSizeSpec("300w").DensitySrcset(src, []float64{2, 1, 1.5, 4})
+	var descs []string
+	for _, e := range got {
+		descs = append(descs, e.Spec.String()+" "+e.Descriptor)
+	}
+	if strings.Join(descs, ", ") != "300w 1x, 450w 1.5x, 600w 2x" {
+		t.Error("got", descs)
+	}
+}
+
+func Test_SrcsetHTML(t *testing.T) {
+	src := image.Rect(0, 0, 1000, 750)
+	entries := MakeSizeSpec("100w").Srcset(src, []int{200, 400})
+	url := func(e SrcsetEntry) string { return "/img/" + e.Spec.String() + ".jpg" }
+	if got := SrcsetAttr(entries, url); got != "/img/200w.jpg 200w, /img/400w.jpg 400w" {
+		t.Error("srcset", got)
+	}
+	sizes := SizesAttr([]SizesRule{{"(max-width: 600px)", "100vw"}}, "400px")
+	if sizes != "(max-width: 600px) 100vw, 400px" {
+		t.Error("sizes", sizes)
+	}
+
+	got := PictureHTML(entries, PictureOptions{
+		Formats: []string{"image/webp", "image/jpeg"},
+		URL: func(e SrcsetEntry, format string) string {
+			return "/img/" + e.Spec.String() + "." + strings.TrimPrefix(format, "image/") + "?a=1&b=2"
+		},
+		Sizes: sizes,
+		Alt:   `a "cat"`,
+	})
+	expected := `<picture>
+  <source type="image/webp" srcset="/img/200w.webp?a=1&amp;b=2 200w, /img/400w.webp?a=1&amp;b=2 400w" sizes="(max-width: 600px) 100vw, 400px">
+  <img src="/img/200w.jpeg?a=1&amp;b=2" srcset="/img/200w.jpeg?a=1&amp;b=2 200w, /img/400w.jpeg?a=1&amp;b=2 400w" sizes="(max-width: 600px) 100vw, 400px" width="200" height="150" alt="a &#34;cat&#34;">
+</picture>`
+	if got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+	if PictureHTML(nil, PictureOptions{}) != "" {
+		t.Error("no entries should be no markup")
+	}
+}
@@ -0,0 +1,418 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrUnknownFormat is returned when asked to encode to a format
+// that ResizeStream doesn't have an encoder for.
+var ErrUnknownFormat = errors.New("resize: unknown output format")
+
+// ErrTooLarge is returned by ResizeStream when the output can't be made
+// to fit in Options.MaxBytes.
+var ErrTooLarge = errors.New("resize: output doesn't fit in MaxBytes")
+
+// ErrInvalidSpec is returned when a size spec doesn't describe
+// an image that can be made, eg, one with no size in it.
+var ErrInvalidSpec = errors.New("resize: invalid size spec")
+
+// ErrWrongSize is returned by ResizeInto when the destination isn't
+// the size the spec makes.
+var ErrWrongSize = errors.New("resize: destination is the wrong size")
+
+// Options control decoding and encoding in ResizeStream.
+// The zero value (or a nil *Options) is fine to use.
+type Options struct {
+	// Format is the output format: "jpeg", "png" or "gif".
+	// If it's empty, the source's format is kept.
+	Format string
+	// JPEGQuality is 1-100. Zero means jpeg.DefaultQuality. With
+	// MaxBytes, it's the highest quality that will be tried.
+	JPEGQuality int
+	// PNGCompression is the zlib compression level for PNG output.
+	PNGCompression png.CompressionLevel
+	// Metadata says which of the source's ICC profile, EXIF and XMP
+	// to keep. The default is to strip them all.
+	Metadata MetadataPolicy
+	// ColorManage converts images with an embedded ICC profile to sRGB
+	// after resizing. The profile is then dropped, since untagged
+	// images are treated as sRGB anyway. If the profile can't be
+	// handled, the image is left alone and a warning is added to the
+	// Result.
+	ColorManage bool
+	// Palette, if it's set, makes PNG and GIF output paletted. See
+	// ResizePaletted.
+	Palette *PaletteOptions
+	// MaxBytes, if it's set, is the largest the output can be. JPEG
+	// quality is lowered as little as possible to fit. PNGs are tried
+	// with the best compression and then quantized to fewer and fewer
+	// colours.
+	MaxBytes int
+	// Fallbacks are size specs, usually smaller ones, to try in order
+	// if the output can't be made to fit in MaxBytes.
+	Fallbacks []string
+	// ShrinkOnLoad lets big JPEGs be decoded at 1/2, 1/4 or 1/8 of
+	// their size when they're going to be scaled down a long way
+	// anyway. It's much faster and uses much less memory, at the cost
+	// of a little sharpness.
+	ShrinkOnLoad bool
+	// ShrinkMargin is how many times bigger than the output (in each
+	// direction) the shrunk image has to stay, for ShrinkOnLoad and
+	// ResizeMany. Bigger margins lose less quality but shrink less
+	// often. Anything below 1 means the default of 2.
+	ShrinkMargin float64
+	// Limits, if set, are checked against the source's header before
+	// it's decoded, and again before each resize. Going over one of
+	// them returns a *LimitError.
+	Limits *Limits
+	// Workers is how many goroutines share the resizing. The default
+	// is one. See ResizeParallel.
+	Workers int
+	// Filter, if it's set, is used to scale the image instead of the
+	// box filter. See ResizeFilter.
+	Filter draw.Scaler
+	// NoUpscale stops images being made bigger. If a spec would
+	// enlarge the source (or its crop), the output is the largest size
+	// with the same aspect ratio that doesn't.
+	NoUpscale bool
+	// Sharpen, if it's set, sharpens images after they're resized, for
+	// specs that don't say how to themselves (with "sharp").
+	Sharpen *SharpenOptions
+	// Overlay, if it's set, is drawn over images after they're
+	// resized, eg, a watermark. It's taken to be sRGB, so it goes on
+	// after colour management.
+	Overlay *Overlay
+	// Background is the colour transparent images are put on when
+	// they're written in a format that can't be transparent, ie,
+	// JPEG. The default is white. A "bg" component in the spec
+	// flattens onto its colour whatever the format.
+	Background color.Color
+}
+
+// plan works out the plan for ss on an image with the given bounds,
+// following the options
+func (self *Options) plan(ss *SizeSpec, bounds image.Rectangle) ResizePlan {
+	return self.adjust(ss.Plan(bounds))
+}
+
+// planImage is plan for the image itself, see SizeSpec.PlanImage
+func (self *Options) planImage(ss *SizeSpec, m image.Image) ResizePlan {
+	return self.adjust(ss.PlanImage(m))
+}
+
+// metadataParts is which metadata has to be read from the source for
+// the options
+func (self *Options) metadataParts() metadataParts {
+	return metadataParts{
+		icc: self.ColorManage || self.Metadata != MetadataStrip,
+		xmp: self.Metadata == MetadataKeepAll,
+	}
+}
+
+// adjust applies the options to a plan
+func (self *Options) adjust(plan ResizePlan) ResizePlan {
+	if plan.sharpen == nil && self.Sharpen != nil {
+		plan.withSharpen(self.Sharpen)
+	}
+	if self.NoUpscale {
+		plan = plan.withoutUpscale()
+	}
+	return plan
+}
+
+// resize carries out plan on m with the options' filter and workers
+func (self *Options) resize(ctx context.Context, m image.Image, plan ResizePlan) (image.Image, error) {
+	out, err := self.scale(ctx, m, plan)
+	if err != nil {
+		return nil, err
+	}
+	return applyOverlay(out, self.Overlay), nil
+}
+
+// scale does the scaling part of resize
+func (self *Options) scale(ctx context.Context, m image.Image, plan ResizePlan) (image.Image, error) {
+	if self.Filter == nil {
+		workers := self.Workers
+		if workers <= 0 {
+			workers = 1
+		}
+		return resizePlanContext(ctx, m, plan, workers)
+	}
+	// other filters can't be cancelled part way through
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out := scalePlan(m, plan, self.Filter)
+	if out == nil {
+		return nil, ErrInvalidSpec
+	}
+	return out, nil
+}
+
+// Result describes the output of ResizeStream.
+type Result struct {
+	// Format is the format the output was encoded in.
+	Format string
+	// Width and Height are the dimensions of the output image.
+	Width  int
+	Height int
+	// Bytes is the number of bytes written.
+	Bytes int64
+	// Spec is the size spec that was used. It's only different from
+	// the one that was asked for if one of the Fallbacks was needed.
+	Spec string
+	// Quality is the JPEG quality used. It's 0 for other formats.
+	Quality int
+	// Attempts is how many times the image was encoded.
+	Attempts int
+	// Warnings are problems that didn't stop the image being written,
+	// but mean it might not be quite what was asked for.
+	Warnings []string
+}
+
+// ResizeStream reads an image from src in any of the registered formats,
+// resizes it according to sizeStr (applying any EXIF orientation first,
+// like ResizeReader) and writes it to dst.
+//
+// If opts.MaxBytes is set, the output is made to fit. If
+// opts.ShrinkOnLoad is set, big JPEGs may be decoded at a reduced size.
+// See Options.
+func ResizeStream(dst io.Writer, src io.Reader, sizeStr string, opts *Options) (*Result, error) {
+	return ResizeStreamContext(context.Background(), dst, src, sizeStr, opts)
+}
+
+// ResizeStreamContext is ResizeStream, but it stops and returns
+// ctx.Err() if ctx is done before the output is written. Decoding can't
+// be interrupted part way through, but resizing can.
+func ResizeStreamContext(ctx context.Context, dst io.Writer, src io.Reader, sizeStr string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	specs := append([]string{sizeStr}, opts.Fallbacks...)
+	sizeSpecs := make([]*SizeSpec, len(specs))
+	for i, spec := range specs {
+		sizeSpecs[i] = MakeSizeSpec(spec)
+	}
+	in, err := decodeOriented(src, sizeSpecs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	format := in.format
+	if opts.Format != "" {
+		format = opts.Format
+	}
+	format = normalizeFormat(format)
+
+	res := &Result{Format: format}
+	for i, spec := range specs {
+		out, meta, warnings, err := render(ctx, in, sizeSpecs[i], format, opts)
+		if err != nil {
+			return nil, err
+		}
+		data, quality, attempts, err := encodeWithin(out, format, meta, opts)
+		res.Attempts += attempts
+		if err == errTooBig {
+			// try the next, smaller, size
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Spec = spec
+		res.Width, res.Height = out.Bounds().Dx(), out.Bounds().Dy()
+		res.Quality = quality
+		res.Warnings = warnings
+		n, err := dst.Write(data)
+		res.Bytes = int64(n)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, ErrTooLarge
+}
+
+// render resizes the source and does everything else that happens
+// before encoding
+func render(ctx context.Context, in *source, ss *SizeSpec, format string, opts *Options) (image.Image, *metadata, []string, error) {
+	var plan ResizePlan
+	if ss.trim != nil {
+		// the source is never shrunk on load for a spec that trims
+		plan = opts.planImage(ss, in.image)
+	} else {
+		plan = in.plan(opts.plan(ss, in.bounds))
+	}
+	if err := opts.Limits.CheckPlan(plan); err != nil {
+		return nil, nil, nil, err
+	}
+	// the background and the overlay are sRGB, so they go on after
+	// colour management
+	bg := plan.Background
+	plan.Background = nil
+	out, err := opts.scale(ctx, in.image, plan)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var warnings []string
+	warnings = append(warnings, in.meta.warnings...)
+	meta := in.meta.filter(opts.Metadata)
+	if opts.ColorManage && len(in.meta.icc) > 0 {
+		if converted, err := ConvertToSRGB(out, in.meta.icc); err == nil {
+			out = converted
+			meta.icc = nil
+		} else {
+			warnings = append(warnings, "colour management skipped: "+err.Error())
+		}
+	}
+	if format == "jpeg" {
+		warnings = append(warnings, meta.jpegWarnings()...)
+	}
+	if bg != nil {
+		out = Flatten(out, bg)
+	}
+	out = applyOverlay(out, opts.Overlay)
+	if !hasAlpha(format) {
+		bg := opts.Background
+		if bg == nil {
+			bg = color.White
+		}
+		out = Flatten(out, bg)
+	}
+	if opts.Palette != nil && (format == "png" || format == "gif") {
+		out = toPaletted(out, sourcePalette(in.image), opts.Palette)
+	}
+	return out, meta, warnings, nil
+}
+
+func normalizeFormat(format string) string {
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// errTooBig is returned by encodeWithin when nothing it tried fit
+var errTooBig = errors.New("resize: too big")
+
+// encodeWithin encodes m, with metadata, keeping within opts.MaxBytes if
+// that's set. For JPEG it searches for the highest quality that fits,
+// for PNG it tries more compression and then fewer colours. It returns
+// the JPEG quality used (0 for other formats) and how many times it
+// encoded the image.
+func encodeWithin(m image.Image, format string, meta *metadata, opts *Options) ([]byte, int, int, error) {
+	attempts := 0
+	try := func(params encodeParams) ([]byte, bool, error) {
+		attempts++
+		var buf bytes.Buffer
+		if err := encode(&buf, params.image(m), format, params); err != nil {
+			return nil, false, err
+		}
+		data := embedMetadata(buf.Bytes(), format, meta)
+		return data, opts.MaxBytes <= 0 || len(data) <= opts.MaxBytes, nil
+	}
+
+	switch format {
+	case "jpeg":
+		ceiling := opts.JPEGQuality
+		if ceiling <= 0 || ceiling > 100 {
+			ceiling = jpeg.DefaultQuality
+		}
+		data, fits, err := try(encodeParams{quality: ceiling})
+		if err != nil || fits {
+			return data, ceiling, attempts, err
+		}
+		// binary search for the highest quality that fits
+		var best []byte
+		bestQuality := 0
+		lo, hi := 1, ceiling-1
+		for lo <= hi {
+			q := (lo + hi) / 2
+			data, fits, err := try(encodeParams{quality: q})
+			if err != nil {
+				return nil, 0, attempts, err
+			}
+			if fits {
+				best, bestQuality = data, q
+				lo = q + 1
+			} else {
+				hi = q - 1
+			}
+		}
+		if best == nil {
+			return nil, 0, attempts, errTooBig
+		}
+		return best, bestQuality, attempts, nil
+	case "png":
+		tries := []encodeParams{{compression: opts.PNGCompression}}
+		if opts.MaxBytes > 0 {
+			tries = append(tries, encodeParams{compression: png.BestCompression})
+			if _, ok := m.(*image.Paletted); !ok {
+				for _, n := range []int{256, 64, 16} {
+					tries = append(tries, encodeParams{compression: png.BestCompression, colors: n})
+				}
+			}
+		}
+		for _, params := range tries {
+			data, fits, err := try(params)
+			if err != nil || fits {
+				return data, 0, attempts, err
+			}
+		}
+		return nil, 0, attempts, errTooBig
+	}
+	data, fits, err := try(encodeParams{})
+	if err == nil && !fits {
+		err = errTooBig
+	}
+	return data, 0, attempts, err
+}
+
+// encodeParams are the settings for one attempt at encoding an image
+type encodeParams struct {
+	quality     int
+	compression png.CompressionLevel
+	// colors, if set, quantizes the image first
+	colors int
+}
+
+// image returns m, quantized if the params ask for it
+func (self encodeParams) image(m image.Image) image.Image {
+	if self.colors > 0 {
+		return toPaletted(m, nil, &PaletteOptions{Quantizer: MedianCut{}, Colors: self.colors})
+	}
+	return m
+}
+
+// encode writes m to w in the given format
+func encode(w io.Writer, m image.Image, format string, params encodeParams) error {
+	switch format {
+	case "jpeg":
+		q := params.quality
+		if q == 0 {
+			q = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: q})
+	case "png":
+		e := png.Encoder{CompressionLevel: params.compression}
+		return e.Encode(w, m)
+	case "gif":
+		return gif.Encode(w, m, nil)
+	}
+	return ErrUnknownFormat
+}
@@ -0,0 +1,156 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func Test_ResizeStream(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+
+	var out bytes.Buffer
+	res, err := ResizeStream(&out, bytes.NewReader(jpg), "10s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Format != "jpeg" || res.Width != 10 || res.Height != 10 {
+		t.Error("bad result", res)
+	}
+	if res.Bytes != int64(out.Len()) {
+		t.Error("byte count", res.Bytes, "doesn't match output", out.Len())
+	}
+	if _, err := jpeg.Decode(&out); err != nil {
+		t.Error("output isn't a JPEG", err)
+	}
+
+	// converting, with encoder options
+	out.Reset()
+	res, err = ResizeStream(&out, bytes.NewReader(jpg), "20w", &Options{Format: "png", PNGCompression: png.BestCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal("output isn't a PNG", err)
+	}
+	if res.Format != "png" || m.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Error("bad png result", res, m.Bounds())
+	}
+
+	// higher quality should mean more bytes
+	var lo, hi bytes.Buffer
+	rlo, _ := ResizeStream(&lo, bytes.NewReader(jpg), "full", &Options{JPEGQuality: 10})
+	rhi, _ := ResizeStream(&hi, bytes.NewReader(jpg), "full", &Options{JPEGQuality: 95})
+	if rlo.Bytes >= rhi.Bytes {
+		t.Error("JPEGQuality doesn't seem to be used", rlo.Bytes, rhi.Bytes)
+	}
+
+	if _, err := ResizeStream(&out, bytes.NewReader(jpg), "10s", &Options{Format: "tiff"}); err != ErrUnknownFormat {
+		t.Error("expected ErrUnknownFormat, got", err)
+	}
+	if _, err := ResizeStream(&out, bytes.NewReader(jpg), "nonsense", nil); err != ErrInvalidSpec {
+		t.Error("expected ErrInvalidSpec, got", err)
+	}
+	if _, err := ResizeStream(failingWriter{}, bytes.NewReader(jpg), "10s", nil); err == nil {
+		t.Error("write errors should be returned")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func Test_MaxBytes(t *testing.T) {
+	src := testJPEG(t, 200, 200)
+
+	var full bytes.Buffer
+	ResizeStream(&full, bytes.NewReader(src), "100s", nil)
+	budget := full.Len() * 2 / 3
+
+	var out bytes.Buffer
+	res, err := ResizeStream(&out, bytes.NewReader(src), "100s", &Options{MaxBytes: budget})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > budget || res.Bytes != int64(out.Len()) {
+		t.Error("output doesn't fit", out.Len(), budget)
+	}
+	if res.Quality <= 0 || res.Quality >= jpeg.DefaultQuality || res.Attempts < 2 {
+		t.Error("bad quality search", res.Quality, res.Attempts)
+	}
+	// one more notch of quality shouldn't fit
+	var next bytes.Buffer
+	ResizeStream(&next, bytes.NewReader(src), "100s", &Options{JPEGQuality: res.Quality + 1})
+	if next.Len() <= budget {
+		t.Error("quality", res.Quality+1, "would have fit too", next.Len(), budget)
+	}
+
+	// a budget that's already met only takes one try
+	res, _ = ResizeStream(&out, bytes.NewReader(src), "100s", &Options{MaxBytes: 1 << 20})
+	if res.Attempts != 1 || res.Quality != jpeg.DefaultQuality {
+		t.Error("shouldn't search when it already fits", res.Attempts, res.Quality)
+	}
+
+	// too small to fit at all
+	if _, err := ResizeStream(&out, bytes.NewReader(src), "100s", &Options{MaxBytes: 100}); err != ErrTooLarge {
+		t.Error("expected ErrTooLarge, got", err)
+	}
+
+	// falling back to a smaller size
+	var tiny bytes.Buffer
+	ResizeStream(&tiny, bytes.NewReader(src), "8s", &Options{JPEGQuality: 1})
+	out.Reset()
+	res, err = ResizeStream(&out, bytes.NewReader(src), "100s", &Options{MaxBytes: tiny.Len(), Fallbacks: []string{"50s", "8s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Spec != "8s" || res.Width != 8 || out.Len() > tiny.Len() {
+		t.Error("bad fallback", res.Spec, res.Width, out.Len(), tiny.Len())
+	}
+
+	// PNGs get squeezed too
+	var pngFull bytes.Buffer
+	ResizeStream(&pngFull, bytes.NewReader(src), "100s", &Options{Format: "png"})
+	out.Reset()
+	res, err = ResizeStream(&out, bytes.NewReader(src), "100s", &Options{Format: "png", MaxBytes: pngFull.Len() / 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > pngFull.Len()/2 || res.Attempts < 2 {
+		t.Error("PNG doesn't fit", out.Len(), pngFull.Len()/2, res.Attempts)
+	}
+	if _, err := png.Decode(&out); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_ResizeStreamContext(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var out bytes.Buffer
+	if _, err := ResizeStreamContext(ctx, &out, bytes.NewReader(jpg), "10s", nil); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+	if out.Len() != 0 {
+		t.Error("nothing should be written once cancelled")
+	}
+
+	var one, four bytes.Buffer
+	if _, err := ResizeStream(&one, bytes.NewReader(jpg), "15w", &Options{Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResizeStream(&four, bytes.NewReader(jpg), "15w", &Options{Format: "png", Workers: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(one.Bytes(), four.Bytes()) {
+		t.Error("output with workers should be identical")
+	}
+}
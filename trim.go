@@ -0,0 +1,230 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resize
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// TrimOptions say what counts as a border to be trimmed off an image.
+type TrimOptions struct {
+	// Color is the colour of the border. If it's nil, it's the colour
+	// that most of the corners are. Fully transparent pixels all match
+	// each other, whatever their colour.
+	Color color.Color
+	// Tolerance is how far (0-255) each channel of a pixel can be from
+	// the border colour and still be part of the border. Zero means an
+	// exact match. JPEG artifacts usually need a little, which is why
+	// "trim" in a spec uses DefaultTrimTolerance.
+	Tolerance int
+}
+
+// DefaultTrimTolerance is the tolerance for a "trim" spec component that
+// doesn't give one.
+const DefaultTrimTolerance = 16
+
+// parseTrim parses the part of a "trim" spec component after the
+// colon: a colour as 6 (or 8, with alpha) hex digits, a tolerance, or
+// both, separated by a comma, eg, "ffffff,10"
+func parseTrim(str string) (*TrimOptions, bool) {
+	t := &TrimOptions{Tolerance: DefaultTrimTolerance}
+	if str == "" {
+		return t, true
+	}
+	fields := strings.Split(str, ",")
+	if len(fields) > 2 {
+		return nil, false
+	}
+	for i, f := range fields {
+		if len(f) == 6 || len(f) == 8 {
+			if i > 0 || t.Color != nil {
+				return nil, false
+			}
+			c, ok := parseHexColor(f)
+			if !ok {
+				return nil, false
+			}
+			t.Color = c
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || n > 255 || (i == 0 && len(fields) > 1) {
+			return nil, false
+		}
+		t.Tolerance = n
+	}
+	return t, true
+}
+
+// parseHexColor parses RRGGBB or RRGGBBAA
+func parseHexColor(str string) (color.NRGBA, bool) {
+	v, err := strconv.ParseUint(str, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	if len(str) == 6 {
+		v = v<<8 | 0xff
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, true
+}
+
+// hexColor is the opposite of parseHexColor, leaving out the alpha
+// when it's opaque
+func hexColor(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A == 0xff {
+		return fmt.Sprintf("%02x%02x%02x", n.R, n.G, n.B)
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", n.R, n.G, n.B, n.A)
+}
+
+func (self *TrimOptions) String() string {
+	var args []string
+	if self.Color != nil {
+		args = append(args, hexColor(self.Color))
+	}
+	if self.Tolerance != DefaultTrimTolerance {
+		args = append(args, strconv.Itoa(self.Tolerance))
+	}
+	if len(args) == 0 {
+		return "trim"
+	}
+	return "trim:" + strings.Join(args, ",")
+}
+
+// ContentRect returns the part of m inside any border, as described by
+// opts. If there's no border, or m is nothing but border, it returns
+// m's bounds.
+func ContentRect(m image.Image, opts TrimOptions) image.Rectangle {
+	r, _ := contentRect(m, opts)
+	return r
+}
+
+// contentRect is ContentRect, but it also says whether there was any
+// content at all, rather than m just being border
+func contentRect(m image.Image, opts TrimOptions) (image.Rectangle, bool) {
+	b := m.Bounds()
+	if b.Empty() {
+		return b, false
+	}
+	rows, scale := rowsFor(m, b)
+	buf := make([]uint64, 4*b.Dx())
+	var bg [4]uint64
+	if opts.Color != nil {
+		r, g, bl, a := opts.Color.RGBA()
+		bg = [4]uint64{uint64(r), uint64(g), uint64(bl), uint64(a)}
+		if scale == 1 {
+			for c := range bg {
+				bg[c] >>= 8
+			}
+		}
+	} else {
+		var ok bool
+		if bg, ok = cornerColor(rows, b, buf, uint64(opts.Tolerance)*scale); !ok {
+			return b, true
+		}
+	}
+
+	tolerance := uint64(opts.Tolerance) * scale
+	isBorder := func(p []uint64) bool {
+		for c := 0; c < 4; c++ {
+			if !within(p[c], bg[c], tolerance) {
+				return false
+			}
+		}
+		return true
+	}
+	content := image.Rectangle{}
+	found := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		rows(y, buf)
+		left, right := -1, -1
+		for x := 0; x < b.Dx(); x++ {
+			if !isBorder(buf[4*x : 4*x+4]) {
+				left = x
+				break
+			}
+		}
+		if left < 0 {
+			continue
+		}
+		for x := b.Dx() - 1; x >= left; x-- {
+			if !isBorder(buf[4*x : 4*x+4]) {
+				right = x
+				break
+			}
+		}
+		row := image.Rect(b.Min.X+left, y, b.Min.X+right+1, y+1)
+		if found {
+			content = content.Union(row)
+		} else {
+			content, found = row, true
+		}
+	}
+	if !found {
+		return b, false
+	}
+	return content, true
+}
+
+// cornerColor returns the colour that most of the corners of the b
+// part of the image read by rows are, within tolerance, or false if no
+// two of them agree
+func cornerColor(rows rowReader, b image.Rectangle, buf []uint64, tolerance uint64) ([4]uint64, bool) {
+	var corners [4][4]uint64
+	rows(b.Min.Y, buf)
+	copy(corners[0][:], buf[:4])
+	copy(corners[1][:], buf[len(buf)-4:])
+	rows(b.Max.Y-1, buf)
+	copy(corners[2][:], buf[:4])
+	copy(corners[3][:], buf[len(buf)-4:])
+	best, votes := 0, 0
+	for i, a := range corners {
+		n := 0
+		for _, c := range corners {
+			if within(a[0], c[0], tolerance) && within(a[1], c[1], tolerance) &&
+				within(a[2], c[2], tolerance) && within(a[3], c[3], tolerance) {
+				n++
+			}
+		}
+		if n > votes {
+			best, votes = i, n
+		}
+	}
+	return corners[best], votes >= 2
+}
+
+// within is true if a and b are no more than tolerance apart
+func within(a, b, tolerance uint64) bool {
+	if a > b {
+		return a-b <= tolerance
+	}
+	return b-a <= tolerance
+}
+
+// PlanImage is like Plan, but for the image itself rather than just its
+// bounds, so that it can take account of anything that depends on the
+// pixels. At the moment that's trimming: Plan doesn't know where the
+// borders are, so it plans as if there weren't any. Resize carries out
+// this plan.
+func (self *SizeSpec) PlanImage(m image.Image) ResizePlan {
+	b := m.Bounds()
+	if self.trim == nil {
+		return self.Plan(b)
+	}
+	return self.planContent(b, ContentRect(m, *self.trim))
+}
+
+// planContent plans for an image with bounds b that's trimmed to
+// content
+func (self *SizeSpec) planContent(b, content image.Rectangle) ResizePlan {
+	p := self.Plan(content)
+	p.Source = b
+	p.NoOp = p.NoOp && content == b
+	return p
+}
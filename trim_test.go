@@ -0,0 +1,152 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+type trimSpecTestCase struct {
+	Spec      string
+	Canonical string
+}
+
+func Test_TrimSpec(t *testing.T) {
+	cases := []trimSpecTestCase{
+		{"trim-100s", "trim-100s"},
+		{"100s-trim", "trim-100s"},
+		{"trim:16-100s", "trim-100s"},
+		{"trim:0-100s", "trim:0-100s"},
+		{"trim:FFFFFF-100s", "trim:ffffff-100s"},
+		{"trim:ffffff,5-100s", "trim:ffffff,5-100s"},
+		{"trim:00000000-100s", "trim:00000000-100s"},
+		{"r90-trim-100s", "trim-r90-100s"},
+		{"trim", "trim-full"},
+		// invalid trimming is ignored
+		{"trim:256-100s", "100s"},
+		{"trim:5,ffffff-100s", "100s"},
+		{"trim:ffffff,ffffff-100s", "100s"},
+		{"trim:1,2-100s", "100s"},
+		{"trim:gggggg-100s", "100s"},
+		{"trim:x-100s", "100s"},
+	}
+	for _, c := range cases {
+		got := MakeSizeSpec(c.Spec).Canonical()
+		if got != c.Canonical {
+			t.Errorf("%s -- got %q, expected %q", c.Spec, got, c.Canonical)
+		}
+		if again := MakeSizeSpec(got).Canonical(); again != got {
+			t.Errorf("%s -- canonical form %q isn't stable, got %q", c.Spec, got, again)
+		}
+	}
+}
+
+// productShot is an image with bounds b, filled with bg apart from a
+// patterned block at content
+func productShot(b, content image.Rectangle, bg color.Color) *image.NRGBA {
+	m := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if (image.Point{x, y}).In(content) {
+				m.Set(x, y, color.NRGBA{uint8(x * 5), 40, uint8(y * 5), 255})
+			} else {
+				m.Set(x, y, bg)
+			}
+		}
+	}
+	return m
+}
+
+type contentRectTestCase struct {
+	Name     string
+	Image    image.Image
+	Opts     TrimOptions
+	Expected image.Rectangle
+}
+
+func Test_ContentRect(t *testing.T) {
+	b := image.Rect(10, 20, 60, 60)
+	content := image.Rect(20, 25, 40, 50)
+	white := color.NRGBA{255, 255, 255, 255}
+	clear := color.NRGBA{255, 0, 0, 0}
+	noisy := productShot(b, content, white)
+	for i := 0; i < len(noisy.Pix); i += 4 * 7 {
+		if x, y := b.Min.X+(i/4)%b.Dx(), b.Min.Y+(i/4)/b.Dx(); !(image.Point{x, y}).In(content) {
+			noisy.Pix[i], noisy.Pix[i+1] = 245, 250
+		}
+	}
+	// one corner is covered by the content, the other three are
+	// still the background
+	corner := productShot(b, image.Rect(10, 20, 30, 30), white)
+	rgba := image.NewRGBA(b)
+	copy(rgba.Pix, productShot(b, content, white).Pix)
+	cases := []contentRectTestCase{
+		{"white", productShot(b, content, white), TrimOptions{}, content},
+		{"rgba", rgba, TrimOptions{}, content},
+		{"transparent", productShot(b, content, clear), TrimOptions{}, content},
+		{"explicit", productShot(b, content, white), TrimOptions{Color: color.White}, content},
+		{"wrong colour", productShot(b, content, white), TrimOptions{Color: color.Black}, b},
+		{"noise, no tolerance", noisy, TrimOptions{}, b},
+		{"noise", noisy, TrimOptions{Tolerance: 10}, content},
+		{"corner", corner, TrimOptions{}, image.Rect(10, 20, 30, 30)},
+		{"no border", productShot(b, b, white), TrimOptions{}, b},
+		{"all border", productShot(b, image.Rectangle{}, white), TrimOptions{}, b},
+		{"empty", image.NewRGBA(image.Rectangle{}), TrimOptions{}, image.Rectangle{}},
+	}
+	for _, c := range cases {
+		if got := ContentRect(c.Image, c.Opts); got != c.Expected {
+			t.Errorf("%s -- got %v, expected %v", c.Name, got, c.Expected)
+		}
+	}
+}
+
+func Test_ResizeTrim(t *testing.T) {
+	b := image.Rect(0, 0, 200, 100)
+	content := image.Rect(80, 30, 120, 70)
+	m := productShot(b, content, color.White)
+
+	plan := MakeSizeSpec("trim-20s").PlanImage(m)
+	if plan.Source != b || plan.Crop != content || plan.Width != 20 || plan.Height != 20 {
+		t.Error("bad plan", plan)
+	}
+	if MakeSizeSpec("trim-20s").Plan(b).Crop == content {
+		t.Error("Plan can't know about the border")
+	}
+	if !MakeSizeSpec("trim").PlanImage(productShot(b, b, color.White)).NoOp {
+		t.Error("trimming nothing off should be a no-op")
+	}
+
+	// the same as resizing just the content
+	want := Resize(m.SubImage(content), "20s").(*image.RGBA)
+	got := Resize(m, "trim-20s").(*image.RGBA)
+	if got.Bounds() != want.Bounds() || !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("trimmed resize differs from resizing the content")
+	}
+	many, err := ResizeMany(m, []string{"trim-20s"})
+	if err != nil || !bytes.Equal(many["trim-20s"].(*image.RGBA).Pix, want.Pix) {
+		t.Error("ResizeMany differs", err)
+	}
+
+	// through a stream, where it mustn't be shrunk on load
+	photo := image.NewGray(image.Rect(0, 0, 800, 400))
+	for i := range photo.Pix {
+		photo.Pix[i] = 255
+	}
+	draw.Draw(photo, image.Rect(380, 180, 420, 220), image.Black, image.Point{}, draw.Src)
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, photo, nil); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	res, err := ResizeStream(&out, &jpg, "trim-full", &Options{ShrinkOnLoad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// JPEG blurs the edges a little
+	if res.Width < 40 || res.Width > 48 || res.Height < 40 || res.Height > 48 {
+		t.Error("stream wasn't trimmed", res.Width, res.Height)
+	}
+}